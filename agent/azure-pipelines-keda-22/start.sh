@@ -6,7 +6,7 @@ if [ -z "$AZP_URL" ]; then
   exit 1
 fi
 
-if [ -z "$AZP_TOKEN_FILE" ]; then
+if [ -z "$AZP_TOKEN_FILE" -a -z "$AZURE_CLIENT_ID" ]; then
   if [ -z "$AZP_TOKEN" ]; then
     echo 1>&2 "error: missing AZP_TOKEN environment variable"
     exit 1
@@ -18,6 +18,51 @@ fi
 
 unset AZP_TOKEN
 
+# azp_token prints the token of the agent, an Azure AD access token for
+# Azure DevOps with workload identity or service principal auth
+azp_token() {
+  if [ -z "$AZURE_CLIENT_ID" ]; then
+    cat "$AZP_TOKEN_FILE"
+    return
+  fi
+
+  if [ -n "$AZURE_FEDERATED_TOKEN_FILE" ]; then
+    credential=(--data-urlencode "client_assertion_type=urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+      --data-urlencode "client_assertion=$(cat "$AZURE_FEDERATED_TOKEN_FILE")")
+  else
+    credential=(--data-urlencode "client_secret=$(cat "$AZURE_CLIENT_SECRET_FILE")")
+  fi
+
+  curl -LsS -X POST "${AZURE_AUTHORITY_HOST%/}/$AZURE_TENANT_ID/oauth2/v2.0/token" \
+    --data-urlencode "grant_type=client_credentials" \
+    --data-urlencode "client_id=$AZURE_CLIENT_ID" \
+    --data-urlencode "scope=499b84ac-1321-427f-aa17-267ca6975798/.default" \
+    "${credential[@]}" | jq -r '.access_token'
+}
+
+# proxy_url prints the proxy URL with the URL encoded PROXY_USER and PROXY_PW,
+# the operator passes the bare URL as the credentials may contain characters
+# that are reserved in URLs
+proxy_url() {
+  case "$1" in
+    *://*) ;;
+    *) printf '%s' "$1"; return ;;
+  esac
+
+  printf '%s://%s:%s@%s' "${1%%://*}" \
+    "$(jq -rn --arg v "$PROXY_USER" '$v|@uri')" \
+    "$(jq -rn --arg v "$PROXY_PW" '$v|@uri')" \
+    "${1#*://}"
+}
+
+if [ -n "$PROXY_URL" -a -n "$PROXY_USER" ]; then
+  for var in HTTP_PROXY HTTPS_PROXY http_proxy https_proxy; do
+    if [ "${!var}" = "$PROXY_URL" ]; then
+      export "$var=$(proxy_url "$PROXY_URL")"
+    fi
+  done
+fi
+
 if [ -n "$AZP_WORK" ]; then
   mkdir -p "$AZP_WORK"
 fi
@@ -31,7 +76,7 @@ cleanup() {
     # If the agent has some running jobs, the configuration removal process will fail.
     # So, give it some time to finish the job.
     while true; do
-      ./config.sh remove --unattended --auth PAT --token $(cat "$AZP_TOKEN_FILE") && break
+      ./config.sh remove --unattended --auth PAT --token $(azp_token) && break
 
       echo "Retrying in 30 seconds..."
       sleep 30
@@ -46,12 +91,18 @@ print_header() {
 }
 
 # Let the agent ignore the token env variables
-export VSO_AGENT_IGNORE=AZP_TOKEN,AZP_TOKEN_FILE
+export VSO_AGENT_IGNORE=AZP_TOKEN,AZP_TOKEN_FILE,AZURE_FEDERATED_TOKEN_FILE,AZURE_CLIENT_SECRET_FILE
 
 print_header "1. Determining matching Azure Pipelines agent..."
 
+if [ -n "$AZURE_CLIENT_ID" ]; then
+  AZP_AUTH=(-H "Authorization: Bearer $(azp_token)")
+else
+  AZP_AUTH=(-u user:$(azp_token))
+fi
+
 AZP_AGENT_PACKAGES=$(curl -LsS \
-    -u user:$(cat "$AZP_TOKEN_FILE") \
+    "${AZP_AUTH[@]}" \
     -H 'Accept:application/json;' \
     "$AZP_URL/_apis/distributedtask/packages/agent?platform=$TARGETARCH&top=1")
 
@@ -82,7 +133,7 @@ print_header "3. Configuring Azure Pipelines agent..."
   --agent "${AZP_AGENT_NAME:-$(hostname)}" \
   --url "$AZP_URL" \
   --auth PAT \
-  --token $(cat "$AZP_TOKEN_FILE") \
+  --token $(azp_token) \
   --pool "${AZP_POOL:-Default}" \
   --work "${AZP_WORK:-_work}" \
   --replace \
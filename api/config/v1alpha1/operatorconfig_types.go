@@ -0,0 +1,216 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+const (
+	// PolicyBackendNetworkPolicy renders the egress policy as a
+	// networking.k8s.io/v1 NetworkPolicy
+	PolicyBackendNetworkPolicy = "NetworkPolicy"
+)
+
+// PodTemplateFields are the fields of the CDTarget spec.podTemplate and the
+// agent extensions spec.sidecars, spec.initContainers, spec.volumes (with
+// spec.volumeMounts) and spec.dind that can be listed in
+// podTemplate.allowedFields
+var PodTemplateFields = []string{
+	"nodeSelector", "tolerations", "affinity", "topologySpreadConstraints",
+	"priorityClassName", "securityContext", "containerSecurityContext",
+	"serviceAccountName", "hostAliases", "runtimeClassName",
+	"sidecars", "initContainers", "volumes", "dind",
+}
+
+//+kubebuilder:object:root=true
+
+// OperatorConfig is the Schema for the operator configuration file, next to
+// the controller manager settings it contains the cluster-wide defaults
+// the operator applies to every CDTarget
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// agent image for CDTargets that do not set spec.agentImage
+	DefaultAgentImage string `json:"defaultAgentImage,omitempty"`
+	// image of the Docker-in-Docker sidecar of CDTargets with spec.dind
+	DinDImage string `json:"dindImage,omitempty"`
+	// source of the allowed egress ports
+	Ports PortsConfig `json:"ports,omitempty"`
+	// override the Azure DevOps CIDRs of the <name>-pool NetworkPolicy
+	AzureDevOpsIPRanges []string `json:"azureDevOpsIPRanges,omitempty"`
+	// CIDRs that CDTargets are not allowed to add as egress target
+	DeniedIPRanges []string `json:"deniedIPRanges,omitempty"`
+	// ports that are never opened, even if listed in the ports ConfigMap
+	DeniedPorts []int32 `json:"deniedPorts,omitempty"`
+	// resource kind used to enforce the egress policy,
+	// only NetworkPolicy is supported
+	PolicyBackend string `json:"policyBackend,omitempty"`
+	// resync and sweep intervals of the operator
+	Resync ResyncConfig `json:"resync,omitempty"`
+	// overrides of the embedded asset manifests
+	Assets AssetsConfig `json:"assets,omitempty"`
+	// pod template fields CDTargets are allowed to set
+	PodTemplate PodTemplateConfig `json:"podTemplate,omitempty"`
+	// validation and expiry warnings of the CDTarget tokens
+	Token TokenConfig `json:"token,omitempty"`
+	// cluster networks that bypass the proxy of CDTargets with spec.proxy
+	Proxy ProxyConfig `json:"proxy,omitempty"`
+}
+
+// ProxyConfig configures the NO_PROXY the operator computes for the agents,
+// the cluster networks, the CDTarget egress IPs and spec.proxy.noProxy
+// bypass the proxy
+type ProxyConfig struct {
+	// service CIDRs of the cluster
+	ServiceCIDRs []string `json:"serviceCIDRs,omitempty"`
+	// pod CIDRs of the cluster
+	PodCIDRs []string `json:"podCIDRs,omitempty"`
+	// DNS domain of the cluster, defaults to cluster.local
+	ClusterDomain string `json:"clusterDomain,omitempty"`
+	// hosts, domains and CIDRs that bypass the proxy for every CDTarget
+	NoProxy []string `json:"noProxy,omitempty"`
+}
+
+// TokenConfig configures the validation of the CDTarget tokens against
+// Azure DevOps
+type TokenConfig struct {
+	// interval between validations of an unchanged token, changed tokens
+	// are validated on the next reconcile
+	ValidationInterval *metav1.Duration `json:"validationInterval,omitempty"`
+	// number of days before the token expiry the operator starts to warn
+	ExpiryWarningDays *int32 `json:"expiryWarningDays,omitempty"`
+	// automated rotation of the PATs of CDTargets with spec.rotateToken
+	Rotation TokenRotationConfig `json:"rotation,omitempty"`
+}
+
+// TokenRotationConfig configures the PATs the operator issues with the
+// Azure DevOps PAT lifecycle API
+type TokenRotationConfig struct {
+	// rotate the PATs of CDTargets with spec.rotateToken
+	Enabled bool `json:"enabled,omitempty"`
+	// Secret in the operator namespace with the AZURE_TENANT_ID,
+	// AZURE_CLIENT_ID, optional AZURE_CLIENT_SECRET of the Azure AD
+	// application and the AZURE_REFRESH_TOKEN of the user that issues the
+	// PATs, defaults to cdtarget-token-rotation
+	CredentialsSecretName string `json:"credentialsSecretName,omitempty"`
+	// scope of the issued PATs, defaults to vso.agentpools_manage
+	Scope string `json:"scope,omitempty"`
+	// lifetime of the issued PATs, defaults to 7 days
+	Lifetime *metav1.Duration `json:"lifetime,omitempty"`
+	// rotate a PAT that expires within this period, defaults to 2 days
+	RotateBefore *metav1.Duration `json:"rotateBefore,omitempty"`
+	// minimum time between the rotation and the revocation of the previous
+	// PAT, the revocation also waits for the agent rollout, defaults to 10m
+	RevokeDelay *metav1.Duration `json:"revokeDelay,omitempty"`
+	// number of rotations kept in the CDTarget status, defaults to 5
+	HistoryLimit *int32 `json:"historyLimit,omitempty"`
+}
+
+// PodTemplateConfig limits the CDTarget spec.podTemplate overlay
+type PodTemplateConfig struct {
+	// fields of spec.podTemplate that are merged onto the agent pod template
+	// and agent extensions that are added to the agent pod, other fields are
+	// skipped, defaults to the scheduling fields and the security contexts,
+	// an empty list allows no fields
+	AllowedFields []string `json:"allowedFields,omitempty"`
+}
+
+// AssetsConfig configures where the operator looks for overrides of the
+// embedded asset manifests, the keys and file names are the manifest names
+// cdtarget_ports.yaml and az-pipelines-pool.yaml
+type AssetsConfig struct {
+	// name of a ConfigMap in the operator namespace with override manifests
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// mounted directory with override manifests
+	Directory string `json:"directory,omitempty"`
+}
+
+// PortsConfig configures the ConfigMap with the allowed egress ports
+type PortsConfig struct {
+	// name of the ConfigMap in the operator namespace, defaults to cdtarget-ports
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// ports used to create the ConfigMap when it does not exist,
+	// defaults to the ports of the embedded manifest
+	Defaults []int32 `json:"defaults,omitempty"`
+}
+
+// ResyncConfig configures the periodic work of the operator
+type ResyncConfig struct {
+	// requeue every CDTarget after a successful reconcile, 0 disables
+	ReconcileInterval *metav1.Duration `json:"reconcileInterval,omitempty"`
+	// interval between stale offline agent sweeps, 0 disables
+	StaleAgentSweepInterval *metav1.Duration `json:"staleAgentSweepInterval,omitempty"`
+	// minimum time an agent is offline before it is removed
+	StaleAgentMaxAge *metav1.Duration `json:"staleAgentMaxAge,omitempty"`
+	// interval between checks of the configuration file for changes
+	ConfigReloadInterval *metav1.Duration `json:"configReloadInterval,omitempty"`
+}
+
+// Validate checks the operator specific settings of the configuration
+func (c *OperatorConfig) Validate() error {
+	if len(c.PolicyBackend) > 0 && c.PolicyBackend != PolicyBackendNetworkPolicy {
+		return fmt.Errorf("unsupported policyBackend %s", c.PolicyBackend)
+	}
+
+	cidrs := append(append([]string{}, c.AzureDevOpsIPRanges...), c.DeniedIPRanges...)
+	cidrs = append(append(cidrs, c.Proxy.ServiceCIDRs...), c.Proxy.PodCIDRs...)
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+		}
+	}
+
+	for _, field := range c.PodTemplate.AllowedFields {
+		known := false
+		for _, f := range PodTemplateFields {
+			known = known || f == field
+		}
+		if !known {
+			return fmt.Errorf("unknown podTemplate field %s", field)
+		}
+	}
+
+	if c.Token.ExpiryWarningDays != nil && *c.Token.ExpiryWarningDays < 0 {
+		return fmt.Errorf("invalid token expiryWarningDays %d", *c.Token.ExpiryWarningDays)
+	}
+
+	if r := c.Token.Rotation; r.Lifetime != nil && r.RotateBefore != nil &&
+		r.RotateBefore.Duration >= r.Lifetime.Duration {
+		return fmt.Errorf("token rotation rotateBefore %s is not shorter than the lifetime %s",
+			r.RotateBefore.Duration, r.Lifetime.Duration)
+	}
+
+	for _, port := range append(append([]int32{}, c.Ports.Defaults...), c.DeniedPorts...) {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	SchemeBuilder.Register(&OperatorConfig{})
+}
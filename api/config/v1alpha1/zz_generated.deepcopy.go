@@ -0,0 +1,254 @@
+//go:build !ignore_autogenerated
+// +build !ignore_autogenerated
+
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AssetsConfig) DeepCopyInto(out *AssetsConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AssetsConfig.
+func (in *AssetsConfig) DeepCopy() *AssetsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(AssetsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperatorConfig) DeepCopyInto(out *OperatorConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ControllerManagerConfigurationSpec.DeepCopyInto(&out.ControllerManagerConfigurationSpec)
+	in.Ports.DeepCopyInto(&out.Ports)
+	if in.AzureDevOpsIPRanges != nil {
+		in, out := &in.AzureDevOpsIPRanges, &out.AzureDevOpsIPRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DeniedIPRanges != nil {
+		in, out := &in.DeniedIPRanges, &out.DeniedIPRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DeniedPorts != nil {
+		in, out := &in.DeniedPorts, &out.DeniedPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	in.Resync.DeepCopyInto(&out.Resync)
+	out.Assets = in.Assets
+	in.PodTemplate.DeepCopyInto(&out.PodTemplate)
+	in.Token.DeepCopyInto(&out.Token)
+	in.Proxy.DeepCopyInto(&out.Proxy)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperatorConfig.
+func (in *OperatorConfig) DeepCopy() *OperatorConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(OperatorConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *OperatorConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateConfig) DeepCopyInto(out *PodTemplateConfig) {
+	*out = *in
+	if in.AllowedFields != nil {
+		in, out := &in.AllowedFields, &out.AllowedFields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateConfig.
+func (in *PodTemplateConfig) DeepCopy() *PodTemplateConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PortsConfig) DeepCopyInto(out *PortsConfig) {
+	*out = *in
+	if in.Defaults != nil {
+		in, out := &in.Defaults, &out.Defaults
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PortsConfig.
+func (in *PortsConfig) DeepCopy() *PortsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PortsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProxyConfig) DeepCopyInto(out *ProxyConfig) {
+	*out = *in
+	if in.ServiceCIDRs != nil {
+		in, out := &in.ServiceCIDRs, &out.ServiceCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PodCIDRs != nil {
+		in, out := &in.PodCIDRs, &out.PodCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NoProxy != nil {
+		in, out := &in.NoProxy, &out.NoProxy
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyConfig.
+func (in *ProxyConfig) DeepCopy() *ProxyConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ProxyConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResyncConfig) DeepCopyInto(out *ResyncConfig) {
+	*out = *in
+	if in.ReconcileInterval != nil {
+		in, out := &in.ReconcileInterval, &out.ReconcileInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.StaleAgentSweepInterval != nil {
+		in, out := &in.StaleAgentSweepInterval, &out.StaleAgentSweepInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.StaleAgentMaxAge != nil {
+		in, out := &in.StaleAgentMaxAge, &out.StaleAgentMaxAge
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ConfigReloadInterval != nil {
+		in, out := &in.ConfigReloadInterval, &out.ConfigReloadInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResyncConfig.
+func (in *ResyncConfig) DeepCopy() *ResyncConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ResyncConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TokenConfig) DeepCopyInto(out *TokenConfig) {
+	*out = *in
+	if in.ValidationInterval != nil {
+		in, out := &in.ValidationInterval, &out.ValidationInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ExpiryWarningDays != nil {
+		in, out := &in.ExpiryWarningDays, &out.ExpiryWarningDays
+		*out = new(int32)
+		**out = **in
+	}
+	in.Rotation.DeepCopyInto(&out.Rotation)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TokenConfig.
+func (in *TokenConfig) DeepCopy() *TokenConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(TokenConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TokenRotationConfig) DeepCopyInto(out *TokenRotationConfig) {
+	*out = *in
+	if in.Lifetime != nil {
+		in, out := &in.Lifetime, &out.Lifetime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.RotateBefore != nil {
+		in, out := &in.RotateBefore, &out.RotateBefore
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.RevokeDelay != nil {
+		in, out := &in.RevokeDelay, &out.RevokeDelay
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.HistoryLimit != nil {
+		in, out := &in.HistoryLimit, &out.HistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TokenRotationConfig.
+func (in *TokenRotationConfig) DeepCopy() *TokenRotationConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(TokenRotationConfig)
+	in.DeepCopyInto(out)
+	return out
+}
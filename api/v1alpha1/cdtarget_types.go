@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -38,6 +39,85 @@ const (
 	ReasonTriggerAuthenticationNotAvailable  = "TriggerAuthenticationNotAvailable"
 	ReasonOperandTriggerAuthenticationFailed = "OperandTriggerAuthenticationFailed"
 	ReasonSucceeded                          = "OperatorSucceeded"
+
+	ReasonOperandNetworkPolicyCreated         = "OperandNetworkPolicyCreated"
+	ReasonOperandNetworkPolicyUpdated         = "OperandNetworkPolicyUpdated"
+	ReasonOperandConfigMapCreated             = "OperandConfigMapCreated"
+	ReasonOperandConfigMapUpdated             = "OperandConfigMapUpdated"
+	ReasonOperandDeploymentCreated            = "OperandDeploymentCreated"
+	ReasonOperandDeploymentUpdated            = "OperandDeploymentUpdated"
+	ReasonOperandSecretCreated                = "OperandSecretCreated"
+	ReasonOperandScaledObjectCreated          = "OperandScaledObjectCreated"
+	ReasonOperandTriggerAuthenticationCreated = "OperandTriggerAuthenticationCreated"
+	ReasonInvalidIPSkipped                    = "InvalidIPSkipped"
+	ReasonDeniedIPSkipped                     = "DeniedIPSkipped"
+	ReasonInvalidPortSkipped                  = "InvalidPortSkipped"
+	ReasonAgentsDeregistered                  = "AgentsDeregistered"
+	ReasonAgentDeregistrationFailed           = "AgentDeregistrationFailed"
+	ReasonStaleAgentsRemoved                  = "StaleAgentsRemoved"
+	ReasonAssetNotAvailable                   = "AssetNotAvailable"
+	ReasonSuspended                           = "Suspended"
+	ReasonResumed                             = "Resumed"
+	ReasonPlanComputed                        = "PlanComputed"
+	ReasonOperandReady                        = "OperandReady"
+	ReasonOperandNotReady                     = "OperandNotReady"
+	ReasonOperandFailed                       = "OperandFailed"
+	ReasonMonitoringNotAvailable              = "MonitoringNotAvailable"
+	ReasonOperandMonitoringFailed             = "OperandMonitoringFailed"
+	ReasonOperandMonitoringCreated            = "OperandMonitoringCreated"
+	ReasonOperandMonitoringUpdated            = "OperandMonitoringUpdated"
+	ReasonOperandDeleted                      = "OperandDeleted"
+	ReasonScaledJobNotAvailable               = "ScaledJobNotAvailable"
+	ReasonOperandScaledJobFailed              = "OperandScaledJobFailed"
+	ReasonOperandScaledJobCreated             = "OperandScaledJobCreated"
+	ReasonOperandScaledJobUpdated             = "OperandScaledJobUpdated"
+	ReasonStatefulSetNotAvailable             = "StatefulSetNotAvailable"
+	ReasonOperandStatefulSetFailed            = "OperandStatefulSetFailed"
+	ReasonOperandStatefulSetCreated           = "OperandStatefulSetCreated"
+	ReasonOperandStatefulSetUpdated           = "OperandStatefulSetUpdated"
+	ReasonStatefulStorageChanged              = "StatefulStorageChanged"
+	ReasonSidecarsNotSupported                = "SidecarsNotSupported"
+	ReasonServiceNotAvailable                 = "ServiceNotAvailable"
+	ReasonOperandServiceFailed                = "OperandServiceFailed"
+	ReasonOperandServiceCreated               = "OperandServiceCreated"
+	ReasonOperandScaledObjectUpdated          = "OperandScaledObjectUpdated"
+	ReasonPodTemplateFieldSkipped             = "PodTemplateFieldSkipped"
+	ReasonServiceAccountNotAvailable          = "ServiceAccountNotAvailable"
+	ReasonOperandServiceAccountFailed         = "OperandServiceAccountFailed"
+	ReasonOperandServiceAccountCreated        = "OperandServiceAccountCreated"
+	ReasonOperandServiceAccountUpdated        = "OperandServiceAccountUpdated"
+	ReasonOperandTriggerAuthenticationUpdated = "OperandTriggerAuthenticationUpdated"
+	ReasonInvalidAuth                         = "InvalidAuth"
+	ReasonTokenValid                          = "TokenValid"
+	ReasonTokenInvalid                        = "TokenInvalid"
+	ReasonTokenNotSet                         = "TokenNotSet"
+	ReasonTokenExpiring                       = "TokenExpiring"
+	ReasonTokenExpired                        = "TokenExpired"
+	ReasonTokenNotVerified                    = "TokenNotVerified"
+	ReasonTokenRotated                        = "TokenRotated"
+	ReasonTokenRevoked                        = "TokenRevoked"
+	ReasonTokenRotationFailed                 = "TokenRotationFailed"
+)
+
+const (
+	// ModeDeployment runs the agents in a Deployment scaled by a KEDA ScaledObject
+	ModeDeployment = "deployment"
+	// ModeJob runs every agent for a single pipeline job in a Job of a KEDA ScaledJob
+	ModeJob = "job"
+	// ModeStateful runs the agents in a StatefulSet with a persistent work
+	// directory per agent, scaled by a KEDA ScaledObject
+	ModeStateful = "stateful"
+)
+
+const (
+	// AuthPAT authenticates the agents and the scaler with the PAT in tokenRef
+	AuthPAT = "pat"
+	// AuthWorkloadIdentity authenticates with Azure AD workload identity
+	// federation of the agent ServiceAccount
+	AuthWorkloadIdentity = "workloadIdentity"
+	// AuthServicePrincipal authenticates the agents with the client secret
+	// of an Azure AD service principal
+	AuthServicePrincipal = "servicePrincipal"
 )
 
 // CDTargetSpec defines the desired state of CDTarget
@@ -56,12 +136,26 @@ type CDTargetSpec struct {
 	MinReplicaCount *int32 `json:"minReplicaCount,omitempty"`
 	// +optional
 	MaxReplicaCount *int32 `json:"maxReplicaCount,omitempty"`
-	// Inject additional environment variables to the deployment
+	// Inject additional environment variables to the deployment, they
+	// override the operator managed and proxy variables with the same name
 	Env []corev1.EnvVar `json:"env,omitempty"`
-	// reference to secret that contains the the Proxy settings
+	// ConfigMaps and Secrets exposed as environment variables of the agent,
+	// variables set by the operator or in env take precedence
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// reference to secret that contains the the Proxy settings,
+	// deprecated in favour of proxy and ignored when proxy is set
 	ProxyRef string `json:"proxyRef,omitempty"`
-	// reference to secret that contains the PAT
-	TokenRef string `json:"tokenRef"`
+	// egress proxy of the agents, the operator computes NO_PROXY
+	Proxy *ProxySpec `json:"proxy,omitempty"`
+	// reference to secret that contains the PAT, required with PAT auth
+	// +optional
+	TokenRef string `json:"tokenRef,omitempty"`
+	// pass the PAT as the AZP_TOKEN environment variable instead of the
+	// AZP_TOKEN_FILE mount, for agent images without AZP_TOKEN_FILE support
+	TokenEnv bool `json:"tokenEnv,omitempty"`
+	// issue and rotate the PAT in tokenRef with the PAT lifecycle API,
+	// requires token rotation in the operator configuration
+	RotateToken bool `json:"rotateToken,omitempty"`
 	// reference to secret that contains the CA certificates
 	CACertRef string `json:"caCertRef,omitempty"`
 	// AzureDevPortal is configuring the Azure DevOps pool settings of the Agent
@@ -73,12 +167,190 @@ type CDTargetSpec struct {
 	// set to override the default DNS config of the agent
 	DNSConfig corev1.PodDNSConfig `json:"dnsConfig,omitempty"`
 	DNSPolicy corev1.DNSPolicy    `json:"dnsPolicy,omitempty"`
+	// stop all operand mutations of the operator for this CDTarget,
+	// the cnad.gofound.nl/suspend: "true" annotation has the same effect
+	Suspend bool `json:"suspend,omitempty"`
+	// scale the agents to zero while suspended by pausing the
+	// ScaledObject with the KEDA paused-replicas annotation
+	SuspendScaleToZero bool `json:"suspendScaleToZero,omitempty"`
+	// generate Prometheus operator monitoring resources for the agents
+	Monitoring *MonitoringSpec `json:"monitoring,omitempty"`
+	// workload of the agents, deployment (default) runs long-lived agents,
+	// job runs an ephemeral agent per pipeline job and stateful keeps the
+	// work directory of every agent on a persistent volume
+	// +kubebuilder:validation:Enum=deployment;job;stateful
+	Mode string `json:"mode,omitempty"`
+	// settings of the KEDA ScaledJob in job mode
+	Job *JobSpec `json:"job,omitempty"`
+	// settings of the work directory volumes in stateful mode
+	Stateful *StatefulSpec `json:"stateful,omitempty"`
+	// fields merged onto the agent pod template, limited to the fields
+	// allowed in the operator configuration
+	PodTemplate *PodTemplateOverlay `json:"podTemplate,omitempty"`
+	// containers that run next to the agent, for example a BuildKit daemon
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+	// containers that run before the agent, for example to seed a tool cache
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// extra volumes of the agent pod
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// extra volume mounts of the agent container
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	// run a Docker-in-Docker sidecar, the agent reaches the daemon through
+	// a shared socket volume and the daemon uses config.mtuValue
+	DinD bool `json:"dind,omitempty"`
+	// authenticate the agents and the scaler with Azure AD instead of the
+	// PAT in tokenRef
+	Auth *AuthSpec `json:"auth,omitempty"`
+}
+
+// AuthSpec configures the Azure AD identity of the agents and the scaler
+type AuthSpec struct {
+	// pat (default), workloadIdentity or servicePrincipal
+	// +kubebuilder:validation:Enum=pat;workloadIdentity;servicePrincipal
+	Type string `json:"type,omitempty"`
+	// client id of the Azure AD application or managed identity
+	ClientID string `json:"clientId,omitempty"`
+	// tenant id of the Azure AD application or managed identity
+	TenantID string `json:"tenantId,omitempty"`
+	// reference to secret that contains the AZURE_CLIENT_SECRET of the
+	// service principal, required with servicePrincipal auth
+	ClientSecretRef string `json:"clientSecretRef,omitempty"`
+	// ServiceAccount of the agents with workloadIdentity auth, defaults to
+	// <name>-agent, the operator sets the workload identity annotations
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+}
+
+// ProxySpec configures the egress proxy of the agents
+type ProxySpec struct {
+	// URL of the proxy, for example http://proxy.example.com:3128
+	// +kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
+	// reference to secret that contains the PROXY_USER and PROXY_PW of the proxy
+	CredentialsRef string `json:"credentialsRef,omitempty"`
+	// hosts, domains and CIDRs added to the computed NO_PROXY
+	NoProxy []string `json:"noProxy,omitempty"`
+}
+
+// PodTemplateOverlay are the agent pod template fields a CDTarget can set,
+// the json names are used in the allowlist of the operator configuration
+type PodTemplateOverlay struct {
+	NodeSelector              map[string]string                 `json:"nodeSelector,omitempty"`
+	Tolerations               []corev1.Toleration               `json:"tolerations,omitempty"`
+	Affinity                  *corev1.Affinity                  `json:"affinity,omitempty"`
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	PriorityClassName         string                            `json:"priorityClassName,omitempty"`
+	// security context of the agent pod
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+	// security context of the agent container
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+	ServiceAccountName       string                  `json:"serviceAccountName,omitempty"`
+	HostAliases              []corev1.HostAlias      `json:"hostAliases,omitempty"`
+	RuntimeClassName         *string                 `json:"runtimeClassName,omitempty"`
+}
+
+// StatefulSpec configures the persistent work directory of the agents in
+// stateful mode
+type StatefulSpec struct {
+	// size of the work directory volume of every agent, defaults to 10Gi
+	Storage *resource.Quantity `json:"storage,omitempty"`
+	// storage class of the work directory volumes, defaults to the
+	// default storage class of the cluster
+	StorageClassName *string `json:"storageClassName,omitempty"`
+}
+
+// JobSpec configures the KEDA ScaledJob of the agents in job mode
+type JobSpec struct {
+	// number of completed agent Jobs that are kept
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// number of failed agent Jobs that are kept
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+	// interval in seconds KEDA checks the agent pool for queued jobs
+	PollingInterval *int32 `json:"pollingInterval,omitempty"`
+	// maximum run time in seconds of an agent Job
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// KEDA scaling strategy of the agent Jobs
+	ScalingStrategy JobScalingStrategy `json:"scalingStrategy,omitempty"`
+}
+
+// JobScalingStrategy mirrors the scaling strategy of a KEDA ScaledJob
+type JobScalingStrategy struct {
+	// +kubebuilder:validation:Enum=default;custom;accurate
+	Strategy string `json:"strategy,omitempty"`
+	// queued jobs subtracted by the custom strategy
+	CustomScalingQueueLengthDeduction *int32 `json:"customScalingQueueLengthDeduction,omitempty"`
+	// percentage of running jobs subtracted by the custom strategy
+	CustomScalingRunningJobPercentage string `json:"customScalingRunningJobPercentage,omitempty"`
+}
+
+// MonitoringSpec configures the monitoring.coreos.com/v1 resources the
+// operator generates for the agents of the CDTarget
+type MonitoringSpec struct {
+	// generate a PrometheusRule with the agent pool alerts
+	Enabled bool `json:"enabled,omitempty"`
+	// labels of the PrometheusRule and PodMonitor, used by the rule and
+	// monitor selectors of Prometheus
+	Labels map[string]string `json:"labels,omitempty"`
+	// generate a PodMonitor for agents that expose metrics
+	PodMonitor *PodMonitorSpec `json:"podMonitor,omitempty"`
+}
+
+// PodMonitorSpec configures the scrape endpoint of the agent pods
+type PodMonitorSpec struct {
+	// name of the container port that exposes the metrics
+	Port string `json:"port"`
+	// HTTP path of the metrics, defaults to /metrics
+	Path string `json:"path,omitempty"`
+	// scrape interval, defaults to the Prometheus scrape interval
+	Interval string `json:"interval,omitempty"`
 }
 
 // CDTargetStatus defines the observed state of CDTarget
 type CDTargetStatus struct {
 	// Conditions lists the most recent status condition updates
 	Conditions []metav1.Condition `json:"conditions"`
+	// expiry of the token, from the cnad.gofound.nl/token-expiry annotation
+	// of the token Secret
+	TokenExpiry *metav1.Time `json:"tokenExpiry,omitempty"`
+	// PATs issued by the operator for tokenRef, the newest last
+	TokenRotations []TokenRotation `json:"tokenRotations,omitempty"`
+	// time of the last stale offline agent sweep
+	LastStaleAgentSweepTime *metav1.Time `json:"lastStaleAgentSweepTime,omitempty"`
+	// total number of stale offline agents removed from the agent pool
+	StaleAgentsRemoved int32 `json:"staleAgentsRemoved,omitempty"`
+	// planned operand changes, only set in plan mode
+	Plan []OperandPlan `json:"plan,omitempty"`
+	// generation of the CDTarget the plan was computed for
+	PlanGeneration int64 `json:"planGeneration,omitempty"`
+}
+
+// TokenRotation is a PAT the operator issued for the token Secret
+type TokenRotation struct {
+	AuthorizationID string      `json:"authorizationId"`
+	IssuedAt        metav1.Time `json:"issuedAt"`
+	ExpiresAt       metav1.Time `json:"expiresAt"`
+	// time the PAT was revoked after it was replaced
+	// +optional
+	RevokedAt *metav1.Time `json:"revokedAt,omitempty"`
+}
+
+// OperandPlan lists the changes the operator would make to an operand
+type OperandPlan struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Create, Update, Unchanged or Drift, Drift is reported for changes
+	// the operator does not apply to an existing operand
+	Action string `json:"action"`
+	// +optional
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// FieldChange is a single changed field of an operand, the values are JSON encoded
+type FieldChange struct {
+	Path string `json:"path"`
+	// +optional
+	Live string `json:"live,omitempty"`
+	// +optional
+	Desired string `json:"desired,omitempty"`
 }
 
 // control the pool and agent work directory
@@ -1,12 +1,29 @@
 package assets
 
 import (
+	"context"
 	"embed"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
 
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PortsManifest is the default ConfigMap with the allowed egress ports
+	PortsManifest = "cdtarget_ports.yaml"
+	// PoolNetworkPolicyManifest is the NetworkPolicy template that allows
+	// the agents to reach Azure DevOps
+	PoolNetworkPolicyManifest = "az-pipelines-pool.yaml"
 )
 
 var (
@@ -27,30 +44,80 @@ func init() {
 	}
 }
 
-func GetConfigMapFromFile(name string) *corev1.ConfigMap {
-	configMapBytes, err := manifests.ReadFile(name)
-	if err != nil {
-		panic(err)
+// Loader reads the manifests from the admin supplied overrides and falls
+// back to the manifests embedded in the operator image. Overrides in the
+// ConfigMap take precedence over overrides in the directory, the data keys
+// of the ConfigMap and the file names in the directory are the manifest names
+type Loader struct {
+	// Client reads the override ConfigMap
+	Client client.Reader
+	// Overrides is the ConfigMap with override manifests, skipped when the name is empty
+	Overrides types.NamespacedName
+	// Dir is a mounted directory with override manifests, skipped when empty
+	Dir string
+}
+
+// read returns the manifest content and a description of its source
+func (l *Loader) read(ctx context.Context, name string) ([]byte, string, error) {
+	if l.Client != nil && len(l.Overrides.Name) > 0 {
+		cm := &corev1.ConfigMap{}
+		err := l.Client.Get(ctx, l.Overrides, cm)
+		if err == nil {
+			if data, ok := cm.Data[name]; ok {
+				return []byte(data), fmt.Sprintf("ConfigMap %s key %s", l.Overrides, name), nil
+			}
+		} else if !errors.IsNotFound(err) {
+			return nil, "", fmt.Errorf("unable to get asset ConfigMap %s: %w", l.Overrides, err)
+		}
+	}
+
+	if len(l.Dir) > 0 {
+		file := filepath.Join(l.Dir, name)
+		data, err := os.ReadFile(file)
+		if err == nil {
+			return data, fmt.Sprintf("file %s", file), nil
+		} else if !os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("unable to read asset %s: %w", file, err)
+		}
 	}
 
-	configMapObject, err := runtime.Decode(appsCodecs.UniversalDecoder(corev1.SchemeGroupVersion), configMapBytes)
+	data, err := manifests.ReadFile(path.Join("manifests", name))
 	if err != nil {
-		panic(err)
+		return nil, "", fmt.Errorf("unable to read embedded asset %s: %w", name, err)
 	}
 
-	return configMapObject.(*corev1.ConfigMap)
+	return data, fmt.Sprintf("embedded manifest %s", name), nil
 }
 
-func GetNetworkPolicyFromFile(name string) *netv1.NetworkPolicy {
-	networkPolicyBytes, err := manifests.ReadFile(name)
+func (l *Loader) decode(ctx context.Context, name string, gv schema.GroupVersion, into runtime.Object) error {
+	data, source, err := l.read(ctx, name)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	networkPolicyObject, err := runtime.Decode(appsCodecs.UniversalDecoder(netv1.SchemeGroupVersion), networkPolicyBytes)
-	if err != nil {
-		panic(err)
+	if err = runtime.DecodeInto(appsCodecs.UniversalDecoder(gv), data, into); err != nil {
+		return fmt.Errorf("unable to decode %s: %w", source, err)
+	}
+
+	return nil
+}
+
+// ConfigMap returns the ConfigMap manifest with the given name
+func (l *Loader) ConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	cm := &corev1.ConfigMap{}
+	if err := l.decode(ctx, name, corev1.SchemeGroupVersion, cm); err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// NetworkPolicy returns the NetworkPolicy manifest with the given name
+func (l *Loader) NetworkPolicy(ctx context.Context, name string) (*netv1.NetworkPolicy, error) {
+	netpol := &netv1.NetworkPolicy{}
+	if err := l.decode(ctx, name, netv1.SchemeGroupVersion, netpol); err != nil {
+		return nil, err
 	}
 
-	return networkPolicyObject.(*netv1.NetworkPolicy)
+	return netpol, nil
 }
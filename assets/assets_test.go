@@ -0,0 +1,68 @@
+package assets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLoaderPrecedence(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, PortsManifest),
+		[]byte("apiVersion: v1\nkind: ConfigMap\ndata:\n  ports: \"8443\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overrides := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-assets", Namespace: "cdtarget-operator"},
+		Data: map[string]string{
+			PortsManifest: "apiVersion: v1\nkind: ConfigMap\ndata:\n  ports: \"9443\"\n",
+		},
+	}
+	key := types.NamespacedName{Name: "cdtarget-assets", Namespace: "cdtarget-operator"}
+
+	tests := []struct {
+		name   string
+		loader *Loader
+		want   string
+	}{
+		{"embedded", &Loader{}, "443"},
+		{"directory", &Loader{Dir: dir}, "8443"},
+		{"configmap", &Loader{Client: fake.NewClientBuilder().WithObjects(overrides).Build(),
+			Overrides: key, Dir: dir}, "9443"},
+		{"missing configmap", &Loader{Client: fake.NewClientBuilder().Build(),
+			Overrides: key, Dir: dir}, "8443"},
+	}
+
+	for _, tt := range tests {
+		cm, err := tt.loader.ConfigMap(ctx, PortsManifest)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if got := strings.Fields(cm.Data["ports"]); len(got) == 0 || got[0] != tt.want {
+			t.Errorf("%s: got ports %q, want %q", tt.name, cm.Data["ports"], tt.want)
+		}
+	}
+}
+
+func TestLoaderDecodeError(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, PoolNetworkPolicyManifest), []byte("spec: ["), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = (&Loader{Dir: dir}).NetworkPolicy(context.Background(), PoolNetworkPolicyManifest); err == nil {
+		t.Fatal("expected a decode error")
+	}
+}
@@ -0,0 +1,224 @@
+package azuredevops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const apiVersion = "7.0"
+
+// Agent is a self-hosted agent registered in an Azure DevOps agent pool
+type Agent struct {
+	ID              int       `json:"id"`
+	Name            string    `json:"name"`
+	Status          string    `json:"status"`
+	Enabled         bool      `json:"enabled"`
+	CreatedOn       time.Time `json:"createdOn"`
+	StatusChangedOn time.Time `json:"statusChangedOn"`
+	// the environment variables of the agent are reported as system
+	// capabilities when the agent registers
+	SystemCapabilities map[string]string `json:"systemCapabilities,omitempty"`
+}
+
+// Online reports if the agent is connected to Azure DevOps
+func (a Agent) Online() bool {
+	return strings.EqualFold(a.Status, "online")
+}
+
+type pool struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type listResponse[T any] struct {
+	Count int `json:"count"`
+	Value []T `json:"value"`
+}
+
+// Client calls the Azure DevOps distributedtask REST API of an organization
+// and authenticates with a personal access token
+type Client struct {
+	URL   string
+	Token string
+	// Bearer sends the token as an Azure AD bearer token instead of a PAT
+	Bearer     bool
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the organization URL, for example
+// https://dev.azure.com/ORGANIZATION
+func NewClient(organizationURL, token string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(organizationURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do calls the API, in is sent as JSON body when it is not nil and the
+// response is decoded into out when it is not nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if len(query.Get("api-version")) == 0 {
+		query.Set("api-version", apiVersion)
+	}
+
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method,
+		fmt.Sprintf("%s/_apis/%s?%s", c.URL, path, query.Encode()), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Bearer {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else {
+		req.SetBasicAuth("", c.Token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// an invalid PAT is redirected to the sign-in page with a 203 status
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == http.StatusNonAuthoritativeInfo {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// StatusError is returned when the API responds with a non 2xx status
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("azure devops %s %s: status %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// Unauthorized reports if the API rejected the credentials
+func (e *StatusError) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden ||
+		e.StatusCode == http.StatusNonAuthoritativeInfo
+}
+
+// ErrPoolNotFound is returned when the agent pool does not exist or is not
+// visible with the credentials of the client
+var ErrPoolNotFound = errors.New("agent pool not found")
+
+// ConnectionData is the identity the credentials of the client authenticate as
+type ConnectionData struct {
+	AuthenticatedUser struct {
+		ID                  string `json:"id"`
+		ProviderDisplayName string `json:"providerDisplayName"`
+	} `json:"authenticatedUser"`
+}
+
+// ConnectionData returns the identity of the credentials of the client
+func (c *Client) ConnectionData(ctx context.Context) (*ConnectionData, error) {
+	var data ConnectionData
+	err := c.do(ctx, http.MethodGet, "connectionData",
+		url.Values{"api-version": []string{apiVersion + "-preview"}}, nil, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// PoolID returns the id of the agent pool with the given name
+func (c *Client) PoolID(ctx context.Context, poolName string) (int, error) {
+	var pools listResponse[pool]
+	err := c.do(ctx, http.MethodGet, "distributedtask/pools",
+		url.Values{"poolName": []string{poolName}}, nil, &pools)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pools.Value {
+		if strings.EqualFold(p.Name, poolName) {
+			return p.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrPoolNotFound, poolName)
+}
+
+// ListAgents returns all agents registered in the agent pool with their
+// system capabilities
+func (c *Client) ListAgents(ctx context.Context, poolID int) ([]Agent, error) {
+	var agents listResponse[Agent]
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("distributedtask/pools/%d/agents", poolID),
+		url.Values{"includeCapabilities": []string{"true"}}, nil, &agents)
+	if err != nil {
+		return nil, err
+	}
+
+	return agents.Value, nil
+}
+
+// DeleteAgent removes the agent registration from the agent pool
+func (c *Client) DeleteAgent(ctx context.Context, poolID, agentID int) error {
+	return c.do(ctx, http.MethodDelete,
+		fmt.Sprintf("distributedtask/pools/%d/agents/%d", poolID, agentID), nil, nil, nil)
+}
+
+// DeleteAgents removes every offline agent in the pool for which match
+// returns true and returns the names of the removed agents, online agents
+// are never removed
+func (c *Client) DeleteAgents(ctx context.Context, poolName string, match func(Agent) bool) ([]string, error) {
+	poolID, err := c.PoolID(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	agents, err := c.ListAgents(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, agent := range agents {
+		if agent.Online() || !match(agent) {
+			continue
+		}
+		if err := c.DeleteAgent(ctx, poolID, agent.ID); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, agent.Name)
+	}
+
+	return deleted, nil
+}
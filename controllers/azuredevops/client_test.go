@@ -0,0 +1,214 @@
+package azuredevops
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer serves the distributedtask pools and agents endpoints for
+// a single agent pool and records the deleted agent ids
+type fakeServer struct {
+	mu      sync.Mutex
+	token   string
+	agents  []Agent
+	deleted []int
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, token, ok := req.BasicAuth(); !ok || token != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/org/_apis/distributedtask/pools":
+		json.NewEncoder(w).Encode(listResponse[pool]{Count: 1, Value: []pool{{ID: 7, Name: "build"}}})
+	case req.Method == http.MethodGet && req.URL.Path == "/org/_apis/distributedtask/pools/7/agents":
+		if req.URL.Query().Get("includeCapabilities") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(listResponse[Agent]{Count: len(f.agents), Value: f.agents})
+	case req.Method == http.MethodDelete && strings.HasPrefix(req.URL.Path, "/org/_apis/distributedtask/pools/7/agents/"):
+		for i, agent := range f.agents {
+			if req.URL.Path == "/org/_apis/distributedtask/pools/7/agents/"+strconv.Itoa(agent.ID) {
+				f.deleted = append(f.deleted, agent.ID)
+				f.agents = append(f.agents[:i], f.agents[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDeleteAgents(t *testing.T) {
+	fake := &fakeServer{
+		token: "pat",
+		agents: []Agent{
+			{ID: 1, Name: "cdtarget-agent-5d8f7-abcde", Status: "offline"},
+			{ID: 2, Name: "other-agent-1", Status: "offline"},
+			{ID: 3, Name: "cdtarget-agent-5d8f7-fghij", Status: "online"},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := NewClient(server.URL+"/org/", "pat")
+	deleted, err := client.DeleteAgents(context.Background(), "build", func(a Agent) bool {
+		return strings.HasPrefix(a.Name, "cdtarget-agent-")
+	})
+	if err != nil {
+		t.Fatalf("DeleteAgents returned error: %v", err)
+	}
+
+	// the online agent 3 is kept
+	if want := []string{"cdtarget-agent-5d8f7-abcde"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted agents = %v, want %v", deleted, want)
+	}
+	if want := []int{1}; !reflect.DeepEqual(fake.deleted, want) {
+		t.Errorf("deleted agent ids = %v, want %v", fake.deleted, want)
+	}
+	if len(fake.agents) != 2 || fake.agents[1].ID != 3 {
+		t.Errorf("remaining agents = %v, want agents 2 and 3", fake.agents)
+	}
+}
+
+func TestDeleteAgentsUnauthorized(t *testing.T) {
+	server := httptest.NewServer(&fakeServer{token: "pat"})
+	defer server.Close()
+
+	_, err := NewClient(server.URL+"/org", "expired").DeleteAgents(context.Background(), "build",
+		func(Agent) bool { return true })
+
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized StatusError, got %v", err)
+	}
+}
+
+func TestClientSecretToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/tenant/oauth2/v2.0/token" || req.FormValue("client_secret") != "secret" ||
+			req.FormValue("scope") != ResourceID+"/.default" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "aad-token"})
+	}))
+	defer server.Close()
+
+	host := AuthorityHost
+	AuthorityHost = server.URL
+	defer func() { AuthorityHost = host }()
+
+	token, err := ClientSecretToken(context.Background(), "tenant", "client", "secret")
+	if err != nil || token != "aad-token" {
+		t.Fatalf("ClientSecretToken = %q, %v, want aad-token", token, err)
+	}
+
+	if _, err = ClientSecretToken(context.Background(), "tenant", "client", "wrong"); err == nil {
+		t.Fatal("expected error for invalid client secret")
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("grant_type") != "refresh_token" || req.FormValue("refresh_token") != "refresh-1" ||
+			req.FormValue("scope") != ResourceID+"/.default offline_access" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "user-token", RefreshToken: "refresh-2"})
+	}))
+	defer server.Close()
+
+	host := AuthorityHost
+	AuthorityHost = server.URL
+	defer func() { AuthorityHost = host }()
+
+	token, refresh, err := RefreshToken(context.Background(), "tenant", "client", "", "refresh-1")
+	if err != nil || token != "user-token" || refresh != "refresh-2" {
+		t.Fatalf("RefreshToken = %q, %q, %v, want user-token, refresh-2", token, refresh, err)
+	}
+
+	if _, _, err = RefreshToken(context.Background(), "tenant", "client", "", "expired"); err == nil {
+		t.Fatal("expected error for expired refresh token")
+	}
+}
+
+func TestConnectionDataSignInRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// an invalid PAT gets the sign-in page instead of a 401
+		w.WriteHeader(http.StatusNonAuthoritativeInfo)
+		w.Write([]byte("<html>sign in</html>"))
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL+"/org", "invalid").ConnectionData(context.Background())
+
+	statusErr, ok := err.(*StatusError)
+	if !ok || !statusErr.Unauthorized() {
+		t.Fatalf("expected unauthorized StatusError, got %v", err)
+	}
+}
+
+func TestIdentityURL(t *testing.T) {
+	for organizationURL, want := range map[string]string{
+		"https://dev.azure.com/org/":         "https://vssps.dev.azure.com/org",
+		"https://org.visualstudio.com":       "https://org.vssps.visualstudio.com",
+		"https://devops.example.com/tfs/org": "",
+	} {
+		got, err := IdentityURL(organizationURL)
+		if got != want || (err != nil) != (want == "") {
+			t.Errorf("IdentityURL(%s) = %q, %v, want %q", organizationURL, got, err, want)
+		}
+	}
+}
+
+func TestCreateAndRevokePAT(t *testing.T) {
+	var revoked string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer aad-token" || req.URL.Path != "/org/_apis/tokens/pats" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.Method {
+		case http.MethodPost:
+			var in patRequest
+			json.NewDecoder(req.Body).Decode(&in)
+			json.NewEncoder(w).Encode(patResponse{PATTokenError: "none", PATToken: PAT{
+				AuthorizationID: "auth-1", DisplayName: in.DisplayName, Scope: in.Scope,
+				ValidTo: in.ValidTo, Token: "new-pat"}})
+		case http.MethodDelete:
+			revoked = req.URL.Query().Get("authorizationId")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/org", "aad-token")
+	client.Bearer = true
+
+	pat, err := client.CreatePAT(context.Background(), "cdtarget-test", "vso.agentpools_manage", time.Now())
+	if err != nil || pat.Token != "new-pat" || pat.AuthorizationID != "auth-1" {
+		t.Fatalf("CreatePAT = %+v, %v", pat, err)
+	}
+
+	if err = client.RevokePAT(context.Background(), pat.AuthorizationID); err != nil || revoked != "auth-1" {
+		t.Fatalf("RevokePAT revoked %q, %v", revoked, err)
+	}
+}
@@ -0,0 +1,98 @@
+package azuredevops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ResourceID is the Azure AD application id of Azure DevOps, access tokens for
+// the REST API and the agent registration are requested for this resource
+const ResourceID = "499b84ac-1321-427f-aa17-267ca6975798"
+
+// AuthorityHost is the Azure AD endpoint the access tokens are requested from
+var AuthorityHost = "https://login.microsoftonline.com"
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// ClientSecretToken requests an Azure AD access token for Azure DevOps with
+// the client credentials of a service principal
+func ClientSecretToken(ctx context.Context, tenantID, clientID, clientSecret string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	form.Set("scope", ResourceID+"/.default")
+
+	token, err := requestToken(ctx, tenantID, clientID, form)
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// RefreshToken redeems the refresh token of a user for an Azure AD access
+// token for Azure DevOps, the client secret is only sent for confidential
+// clients. Azure AD returns a new refresh token that replaces the redeemed
+// one, the redeemed refresh token is returned when Azure AD returns none
+func RefreshToken(ctx context.Context, tenantID, clientID, clientSecret, refreshToken string) (string, string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("client_id", clientID)
+	if len(clientSecret) > 0 {
+		form.Set("client_secret", clientSecret)
+	}
+	form.Set("refresh_token", refreshToken)
+	form.Set("scope", ResourceID+"/.default offline_access")
+
+	token, err := requestToken(ctx, tenantID, clientID, form)
+	if err != nil {
+		return "", "", err
+	}
+	if len(token.RefreshToken) == 0 {
+		token.RefreshToken = refreshToken
+	}
+
+	return token.AccessToken, token.RefreshToken, nil
+}
+
+// requestToken posts the form to the token endpoint of the tenant
+func requestToken(ctx context.Context, tenantID, clientID string, form url.Values) (*tokenResponse, error) {
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(AuthorityHost, "/"), tenantID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &StatusError{Method: http.MethodPost, Path: "oauth2/v2.0/token",
+			StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var token tokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if len(token.AccessToken) == 0 {
+		return nil, fmt.Errorf("no access token for client %s in tenant %s", clientID, tenantID)
+	}
+
+	return &token, nil
+}
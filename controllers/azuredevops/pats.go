@@ -0,0 +1,81 @@
+package azuredevops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// patAPIVersion is the version of the PAT lifecycle management API
+const patAPIVersion = "7.1-preview.1"
+
+// PAT is a personal access token issued through the PAT lifecycle API, the
+// token is only returned when the PAT is created
+type PAT struct {
+	AuthorizationID string    `json:"authorizationId"`
+	DisplayName     string    `json:"displayName"`
+	Scope           string    `json:"scope"`
+	ValidTo         time.Time `json:"validTo"`
+	Token           string    `json:"token,omitempty"`
+}
+
+type patRequest struct {
+	DisplayName string    `json:"displayName"`
+	Scope       string    `json:"scope"`
+	ValidTo     time.Time `json:"validTo"`
+	AllOrgs     bool      `json:"allOrgs"`
+}
+
+type patResponse struct {
+	PATToken      PAT    `json:"patToken"`
+	PATTokenError string `json:"patTokenError"`
+}
+
+// IdentityURL returns the URL of the identity service of the organization
+// that serves the PAT lifecycle API, for example
+// https://vssps.dev.azure.com/ORGANIZATION
+func IdentityURL(organizationURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(organizationURL, "/"))
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case u.Host == "dev.azure.com":
+		u.Host = "vssps.dev.azure.com"
+	case strings.HasSuffix(u.Host, ".visualstudio.com"):
+		u.Host = strings.TrimSuffix(u.Host, ".visualstudio.com") + ".vssps.visualstudio.com"
+	default:
+		return "", fmt.Errorf("no PAT lifecycle API for organization URL %s", organizationURL)
+	}
+
+	return u.String(), nil
+}
+
+// CreatePAT issues a PAT for the organization of the client, the client
+// has to authenticate with an Azure AD token on the identity service URL
+func (c *Client) CreatePAT(ctx context.Context, displayName, scope string, validTo time.Time) (*PAT, error) {
+	var resp patResponse
+	err := c.do(ctx, http.MethodPost, "tokens/pats", url.Values{"api-version": []string{patAPIVersion}},
+		patRequest{DisplayName: displayName, Scope: scope, ValidTo: validTo.UTC()}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.PATTokenError) > 0 && resp.PATTokenError != "none" {
+		return nil, fmt.Errorf("PAT %s not issued: %s", displayName, resp.PATTokenError)
+	}
+
+	return &resp.PATToken, nil
+}
+
+// RevokePAT revokes the PAT with the authorization id
+func (c *Client) RevokePAT(ctx context.Context, authorizationID string) error {
+	return c.do(ctx, http.MethodDelete, "tokens/pats", url.Values{
+		"api-version":     []string{patAPIVersion},
+		"authorizationId": []string{authorizationID},
+	}, nil, nil)
+}
@@ -1,11 +1,13 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
 
 	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -17,6 +19,9 @@ func (r *CDTargetReconciler) configMapForCDTarget(t *cnadv1alpha1.CDTarget) *cor
 	data["AZP_POOL"] = string(t.Spec.Config.PoolName)
 	data["AZP_URL"] = string(t.Spec.Config.URL)
 	data["AZP_WORK"] = string(t.Spec.Config.WorkDir)
+	if agentMode(t) == cnadv1alpha1.ModeStateful {
+		data["AZP_WORK"] = agentWorkDir(t)
+	}
 	data["AZP_AGENT_NAME"] = string(t.Spec.Config.AgentName)
 	data["AGENT_MTU_VALUE"] = string(t.Spec.Config.MTUValue)
 
@@ -32,6 +37,62 @@ func (r *CDTargetReconciler) configMapForCDTarget(t *cnadv1alpha1.CDTarget) *cor
 	return cm
 }
 
+const (
+	// tokenVolumeName is the projected volume with the PAT of the agent
+	tokenVolumeName = "azp-token"
+	// tokenMountPath is the directory the PAT is mounted in, the kubelet
+	// updates the file when the token Secret changes
+	tokenMountPath = "/var/run/secrets/azure-pipelines"
+)
+
+// tokenFileMounted reports if the PAT is mounted as AZP_TOKEN_FILE
+func tokenFileMounted(t *cnadv1alpha1.CDTarget) bool {
+	return !t.Spec.TokenEnv
+}
+
+// addAgentToken passes the PAT to the agent container, by default as a file
+// in a read-only projected volume so it is not visible in the environment
+func addAgentToken(t *cnadv1alpha1.CDTarget, spec *corev1.PodSpec) {
+	env := corev1.EnvVar{
+		Name: "AZP_TOKEN",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: t.Spec.TokenRef},
+				Key: "AZP_TOKEN",
+			},
+		},
+	}
+
+	if tokenFileMounted(t) {
+		env = corev1.EnvVar{Name: "AZP_TOKEN_FILE", Value: tokenMountPath + "/AZP_TOKEN"}
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: tokenVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{
+						Secret: &corev1.SecretProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: t.Spec.TokenRef},
+							Items:                []corev1.KeyToPath{{Key: "AZP_TOKEN", Path: "AZP_TOKEN"}},
+						},
+					}},
+				},
+			},
+		})
+	}
+
+	for i, container := range spec.Containers {
+		if container.Name != "agent" {
+			continue
+		}
+		spec.Containers[i].Env = append(spec.Containers[i].Env, env)
+		if tokenFileMounted(t) {
+			spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts,
+				corev1.VolumeMount{Name: tokenVolumeName, MountPath: tokenMountPath, ReadOnly: true})
+		}
+	}
+}
+
 func (r *CDTargetReconciler) tokenSecretForCDTarget(t *cnadv1alpha1.CDTarget) *corev1.Secret {
 
 	name := t.Spec.TokenRef
@@ -51,12 +112,34 @@ func (r *CDTargetReconciler) tokenSecretForCDTarget(t *cnadv1alpha1.CDTarget) *c
 	return &sec
 }
 
+const (
+	// defaultAgentWorkDir is the work directory of the agents in stateful
+	// mode when config.workDir is not set
+	defaultAgentWorkDir = "/azp/_work"
+	// workVolumeName is the volume claim template of the work directory
+	workVolumeName = "work"
+)
+
+// agentWorkDir returns the work directory mounted from the persistent volume
+func agentWorkDir(t *cnadv1alpha1.CDTarget) string {
+	if len(t.Spec.Config.WorkDir) > 0 {
+		return t.Spec.Config.WorkDir
+	}
+
+	return defaultAgentWorkDir
+}
+
 func boolPointer(b bool) *bool {
 	return &b
 }
 
 func (r *CDTargetReconciler) deploymentForCDTarget(t *cnadv1alpha1.CDTarget) *appsv1.Deployment {
 
+	image := t.Spec.AgentImage
+	if len(image) == 0 {
+		image = r.operatorConfig().DefaultAgentImage
+	}
+
 	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      t.Name,
@@ -77,13 +160,17 @@ func (r *CDTargetReconciler) deploymentForCDTarget(t *cnadv1alpha1.CDTarget) *ap
 					DNSPolicy:        t.Spec.DNSPolicy,
 					ImagePullSecrets: t.Spec.ImagePullSecrets,
 					Containers: []corev1.Container{{
-						Image: t.Spec.AgentImage,
+						Image: image,
 						Name:  "agent",
 						Resources: corev1.ResourceRequirements{
 							Requests: t.Spec.AgentResources.Requests,
 							Limits:   t.Spec.AgentResources.Limits,
 						},
 						Env: []corev1.EnvVar{
+							{
+								Name:  agentOwnerEnv,
+								Value: string(t.UID),
+							},
 							{
 								Name: "AZP_URL",
 								ValueFrom: &corev1.EnvVarSource{
@@ -137,16 +224,6 @@ func (r *CDTargetReconciler) deploymentForCDTarget(t *cnadv1alpha1.CDTarget) *ap
 									},
 								},
 							},
-							{
-								Name: "AZP_TOKEN",
-								ValueFrom: &corev1.EnvVarSource{
-									SecretKeyRef: &corev1.SecretKeySelector{
-										LocalObjectReference: corev1.LocalObjectReference{
-											Name: t.Spec.TokenRef},
-										Key: "AZP_TOKEN",
-									},
-								},
-							},
 						},
 					}},
 				},
@@ -196,170 +273,137 @@ func (r *CDTargetReconciler) deploymentForCDTarget(t *cnadv1alpha1.CDTarget) *ap
 
 	}
 
-	if len(t.Spec.Env) > 0 {
-		for i, container := range dep.Spec.Template.Spec.Containers {
-			if container.Name == "agent" {
-				for _, env := range t.Spec.Env {
-					dep.Spec.Template.Spec.Containers[i].Env =
-						append(dep.Spec.Template.Spec.Containers[i].Env, env)
+	addAgentAuth(t, &dep.Spec.Template.Spec)
+	r.addAgentExtensions(t, &dep.Spec.Template.Spec)
+
+	// operator managed variables first, then the proxy variables and the
+	// env of the CDTarget, a later variable overrides an earlier one
+	for i, container := range dep.Spec.Template.Spec.Containers {
+		if container.Name == "agent" {
+			c := &dep.Spec.Template.Spec.Containers[i]
+			c.Env = mergeEnv(c.Env, proxyEnvForCDTarget(t, r.operatorConfig()), t.Spec.Env)
+			c.EnvFrom = append(c.EnvFrom, t.Spec.EnvFrom...)
+		}
+	}
+
+	r.applyPodTemplateOverlay(t, &dep.Spec.Template)
+
+	return dep
+}
+
+// statefulStorage returns the size and storage class of the work
+// directory volume claims in stateful mode
+func statefulStorage(t *cnadv1alpha1.CDTarget) (resource.Quantity, *string) {
+	storage := resource.MustParse("10Gi")
+	var storageClassName *string
+	if t.Spec.Stateful != nil {
+		if t.Spec.Stateful.Storage != nil {
+			storage = *t.Spec.Stateful.Storage
+		}
+		storageClassName = t.Spec.Stateful.StorageClassName
+	}
+
+	return storage, storageClassName
+}
+
+// statefulSetForCDTarget runs the agent pod template of the Deployment in a
+// StatefulSet with a persistent work directory per agent, the agents are
+// named after the pods so the agent names follow the pod ordinals unless
+// spec.env sets AZP_AGENT_NAME
+func (r *CDTargetReconciler) statefulSetForCDTarget(t *cnadv1alpha1.CDTarget) *appsv1.StatefulSet {
+	dep := r.deploymentForCDTarget(t)
+	template := dep.Spec.Template
+
+	userAgentName := false
+	for _, env := range t.Spec.Env {
+		userAgentName = userAgentName || env.Name == "AZP_AGENT_NAME"
+	}
+
+	for i, container := range template.Spec.Containers {
+		if container.Name != "agent" {
+			continue
+		}
+		for j, env := range container.Env {
+			if env.Name == "AZP_AGENT_NAME" && !userAgentName {
+				template.Spec.Containers[i].Env[j] = corev1.EnvVar{
+					Name: "AZP_AGENT_NAME",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+					},
 				}
 			}
 		}
+		template.Spec.Containers[i].VolumeMounts = append(template.Spec.Containers[i].VolumeMounts,
+			corev1.VolumeMount{Name: workVolumeName, MountPath: agentWorkDir(t)})
 	}
 
-	if len(t.Spec.ProxyRef) > 0 {
-		proxy := []corev1.EnvVar{
-			{
-				Name: "AZP_URL",
-				ValueFrom: &corev1.EnvVarSource{
-					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-config", t.Name)},
-						Key: "AZP_URL",
-					},
-				},
-			},
-			{
-				Name: "AZP_POOL",
-				ValueFrom: &corev1.EnvVarSource{
-					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-config", t.Name)},
-						Key: "AZP_POOL",
-					},
-				},
-			},
-			{
-				Name: "AZP_WORK",
-				ValueFrom: &corev1.EnvVarSource{
-					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-config", t.Name)},
-						Optional: boolPointer(true),
-						Key:      "AZP_WORK",
-					},
-				},
-			},
-			{
-				Name: "AZP_AGENT_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-config", t.Name)},
-						Optional: boolPointer(true),
-						Key:      "AZP_AGENT_NAME",
-					},
-				},
-			},
-			{
-				Name: "AGENT_MTU_VALUE",
-				ValueFrom: &corev1.EnvVarSource{
-					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-config", t.Name)},
-						Optional: boolPointer(true),
-						Key:      "AGENT_MTU_VALUE",
-					},
-				},
-			},
-			{
-				Name: "AZP_TOKEN",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.TokenRef},
-						Key: "AZP_TOKEN",
-					},
-				},
-			},
-			{
-				Name: "HTTP_PROXY",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "HTTP_PROXY",
-					},
-				},
-			},
-			{
-				Name: "HTTPS_PROXY",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "HTTPS_PROXY",
-					},
-				},
-			},
-			{
-				Name: "PROXY_USER",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "PROXY_USER",
-					},
-				},
-			},
-			{
-				Name: "PROXY_PW",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "PROXY_PW",
-					},
-				},
-			},
-			{
-				Name: "PROXY_URL",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "PROXY_URL",
-					},
-				},
-			},
-			{
-				Name: "FTP_PROXY",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "FTP_PROXY",
-					},
+	storage, storageClassName := statefulStorage(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: dep.ObjectMeta,
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:            dep.Spec.Replicas,
+			Selector:            dep.Spec.Selector,
+			ServiceName:         t.Name,
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			Template:            template,
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   workVolumeName,
+					Labels: t.Spec.AdditionalSelector,
 				},
-			},
-			{
-				Name: "NO_PROXY",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: t.Spec.ProxyRef},
-						Optional: boolPointer(true),
-						Key:      "NO_PROXY",
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					StorageClassName: storageClassName,
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: storage},
 					},
 				},
-			},
-		}
+			}},
+		},
+	}
 
-		for i, container := range dep.Spec.Template.Spec.Containers {
-			if container.Name == "agent" {
-				for _, env := range proxy {
-					dep.Spec.Template.Spec.Containers[i].Env =
-						append(dep.Spec.Template.Spec.Containers[i].Env, env)
-				}
-			}
-		}
+	return sts
+}
+
+// headlessServiceForCDTarget returns the headless Service that governs the
+// network identity of the StatefulSet agent pods
+func headlessServiceForCDTarget(t *cnadv1alpha1.CDTarget) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      t.Name,
+			Namespace: t.Namespace,
+			Labels:    t.Spec.AdditionalSelector,
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  t.Spec.AdditionalSelector,
+		},
 	}
+}
 
-	return dep
+// validateStatefulStorage warns when the work directory volume claims of the
+// live StatefulSet differ from spec.stateful, the volume claim templates of
+// a StatefulSet are immutable and only apply to new claims after the
+// StatefulSet is recreated
+func (r *CDTargetReconciler) validateStatefulStorage(ctx context.Context, t *cnadv1alpha1.CDTarget) {
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, ownedKey(t), sts); err != nil {
+		return
+	}
+
+	storage, storageClassName := statefulStorage(t)
+	for _, claim := range sts.Spec.VolumeClaimTemplates {
+		if claim.Name != workVolumeName {
+			continue
+		}
+		live := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+		classChanged := storageClassName != nil &&
+			(claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != *storageClassName)
+		if live.Cmp(storage) != 0 || classChanged {
+			r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonStatefulStorageChanged,
+				"stateful storage changes are not applied to the volume claim templates of StatefulSet %s, "+
+					"delete the StatefulSet with --cascade=orphan to recreate it", sts.Name)
+		}
+	}
 }
@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// workload identity annotations of the agent ServiceAccount, the same
+	// annotations the Azure workload identity webhook reads
+	workloadIdentityClientIDAnnotation = "azure.workload.identity/client-id"
+	workloadIdentityTenantIDAnnotation = "azure.workload.identity/tenant-id"
+
+	// workloadIdentityAudience is the audience of the projected token that
+	// Azure AD accepts as client assertion
+	workloadIdentityAudience = "api://AzureADTokenExchange"
+
+	azureIdentityVolumeName = "azure-identity"
+	azureIdentityMountPath  = "/var/run/secrets/azure/tokens"
+	azureAuthorityHost      = "https://login.microsoftonline.com/"
+)
+
+// authType returns the auth type of the CDTarget, PAT when spec.auth is not set
+func authType(t *cnadv1alpha1.CDTarget) string {
+	if t.Spec.Auth == nil || len(t.Spec.Auth.Type) == 0 {
+		return cnadv1alpha1.AuthPAT
+	}
+
+	return t.Spec.Auth.Type
+}
+
+// validateAuth reports a missing field of the configured auth type, with
+// workload identity the agents have to run as the annotated ServiceAccount
+func validateAuth(t *cnadv1alpha1.CDTarget) error {
+	if authType(t) == cnadv1alpha1.AuthWorkloadIdentity && t.Spec.PodTemplate != nil &&
+		len(t.Spec.PodTemplate.ServiceAccountName) > 0 && t.Spec.PodTemplate.ServiceAccountName != agentServiceAccountName(t) {
+		return fmt.Errorf("podTemplate.serviceAccountName can not be combined with %s auth, set auth.serviceAccountName",
+			cnadv1alpha1.AuthWorkloadIdentity)
+	}
+
+	switch authType(t) {
+	case cnadv1alpha1.AuthPAT:
+		if len(t.Spec.TokenRef) == 0 {
+			return fmt.Errorf("tokenRef is required with %s auth", cnadv1alpha1.AuthPAT)
+		}
+	case cnadv1alpha1.AuthServicePrincipal:
+		if len(t.Spec.Auth.ClientSecretRef) == 0 {
+			return fmt.Errorf("auth.clientSecretRef is required with %s auth", cnadv1alpha1.AuthServicePrincipal)
+		}
+		fallthrough
+	default:
+		if len(t.Spec.Auth.ClientID) == 0 || len(t.Spec.Auth.TenantID) == 0 {
+			return fmt.Errorf("auth.clientId and auth.tenantId are required with %s auth", authType(t))
+		}
+	}
+
+	return nil
+}
+
+// agentServiceAccountName returns the ServiceAccount of the agents with
+// workload identity auth
+func agentServiceAccountName(t *cnadv1alpha1.CDTarget) string {
+	if t.Spec.Auth != nil && len(t.Spec.Auth.ServiceAccountName) > 0 {
+		return t.Spec.Auth.ServiceAccountName
+	}
+
+	return fmt.Sprintf("%s-agent", t.Name)
+}
+
+func serviceAccountEnabled(t *cnadv1alpha1.CDTarget) bool {
+	return authType(t) == cnadv1alpha1.AuthWorkloadIdentity
+}
+
+func (r *CDTargetReconciler) serviceAccountForCDTarget(t *cnadv1alpha1.CDTarget) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      agentServiceAccountName(t),
+			Namespace: t.Namespace,
+			Labels:    t.Spec.AdditionalSelector,
+			Annotations: map[string]string{
+				workloadIdentityClientIDAnnotation: t.Spec.Auth.ClientID,
+				workloadIdentityTenantIDAnnotation: t.Spec.Auth.TenantID,
+			},
+		},
+	}
+}
+
+// updateServiceAccount applies the workload identity annotations, other
+// annotations of the ServiceAccount are left untouched
+func updateServiceAccount(live, desired client.Object) bool {
+	changed := false
+	annotations := live.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for k, v := range desired.GetAnnotations() {
+		if annotations[k] != v {
+			annotations[k] = v
+			changed = true
+		}
+	}
+	live.SetAnnotations(annotations)
+
+	return changed
+}
+
+// triggerAuthenticationIdentity returns the KEDA pod identity of the scaler,
+// nil with PAT auth, the KEDA operator authenticates with the client id
+// through its own workload identity federation
+func triggerAuthenticationIdentity(t *cnadv1alpha1.CDTarget) *kedav2.AuthPodIdentity {
+	if authType(t) == cnadv1alpha1.AuthPAT {
+		return nil
+	}
+
+	return &kedav2.AuthPodIdentity{Provider: kedav2.PodIdentityProviderAzureWorkload, IdentityID: t.Spec.Auth.ClientID}
+}
+
+// updateTriggerAuthentication switches the TriggerAuthentication between
+// the PAT and the pod identity when the auth type changes, manual changes
+// to the live TriggerAuthentication are kept otherwise
+func updateTriggerAuthentication(live, desired client.Object) bool {
+	l, d := live.(*kedav2.TriggerAuthentication), desired.(*kedav2.TriggerAuthentication)
+	if equality.Semantic.DeepEqual(l.Spec.PodIdentity, d.Spec.PodIdentity) {
+		return false
+	}
+
+	l.Spec.PodIdentity = d.Spec.PodIdentity
+	l.Spec.SecretTargetRef = d.Spec.SecretTargetRef
+	return true
+}
+
+// addAgentAuth passes the credentials of the auth type to the agent container
+func addAgentAuth(t *cnadv1alpha1.CDTarget, spec *corev1.PodSpec) {
+	switch authType(t) {
+	case cnadv1alpha1.AuthPAT:
+		addAgentToken(t, spec)
+		return
+	case cnadv1alpha1.AuthWorkloadIdentity:
+		spec.ServiceAccountName = agentServiceAccountName(t)
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "AZURE_CLIENT_ID", Value: t.Spec.Auth.ClientID},
+		{Name: "AZURE_TENANT_ID", Value: t.Spec.Auth.TenantID},
+		{Name: "AZURE_AUTHORITY_HOST", Value: azureAuthorityHost},
+	}
+
+	// the projected service account token is the client assertion of the
+	// workload identity, the client secret is projected from its Secret
+	var projection corev1.VolumeProjection
+	if authType(t) == cnadv1alpha1.AuthServicePrincipal {
+		projection.Secret = &corev1.SecretProjection{
+			LocalObjectReference: corev1.LocalObjectReference{Name: t.Spec.Auth.ClientSecretRef},
+			Items:                []corev1.KeyToPath{{Key: "AZURE_CLIENT_SECRET", Path: "AZURE_CLIENT_SECRET"}},
+		}
+		env = append(env, corev1.EnvVar{Name: "AZURE_CLIENT_SECRET_FILE",
+			Value: azureIdentityMountPath + "/AZURE_CLIENT_SECRET"})
+	} else {
+		projection.ServiceAccountToken = &corev1.ServiceAccountTokenProjection{
+			Audience:          workloadIdentityAudience,
+			ExpirationSeconds: pointer.Int64(3600),
+			Path:              "azure-identity-token",
+		}
+		env = append(env, corev1.EnvVar{Name: "AZURE_FEDERATED_TOKEN_FILE",
+			Value: azureIdentityMountPath + "/azure-identity-token"})
+	}
+
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: azureIdentityVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{projection}},
+		},
+	})
+
+	for i, container := range spec.Containers {
+		if container.Name != "agent" {
+			continue
+		}
+		spec.Containers[i].Env = append(spec.Containers[i].Env, env...)
+		spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts,
+			corev1.VolumeMount{Name: azureIdentityVolumeName, MountPath: azureIdentityMountPath, ReadOnly: true})
+	}
+}
+
+// clientForCDTarget returns an Azure DevOps client with the credentials of
+// the CDTarget, nil when the operator has no credentials for the agent pool,
+// the operator has no workload identity of the agents
+func clientForCDTarget(ctx context.Context, c client.Client, t *cnadv1alpha1.CDTarget) (*azuredevops.Client, error) {
+	switch authType(t) {
+	case cnadv1alpha1.AuthPAT:
+		token := &corev1.Secret{}
+		err := c.Get(ctx, types.NamespacedName{Name: t.Spec.TokenRef, Namespace: t.Namespace}, token)
+		if err != nil || len(token.Data["AZP_TOKEN"]) == 0 {
+			return nil, err
+		}
+		return azuredevops.NewClient(t.Spec.Config.URL, string(token.Data["AZP_TOKEN"])), nil
+	case cnadv1alpha1.AuthServicePrincipal:
+		secret := &corev1.Secret{}
+		err := c.Get(ctx, types.NamespacedName{Name: t.Spec.Auth.ClientSecretRef, Namespace: t.Namespace}, secret)
+		if err != nil || len(secret.Data["AZURE_CLIENT_SECRET"]) == 0 {
+			return nil, err
+		}
+		token, err := azuredevops.ClientSecretToken(ctx, t.Spec.Auth.TenantID, t.Spec.Auth.ClientID,
+			string(secret.Data["AZURE_CLIENT_SECRET"]))
+		if err != nil {
+			return nil, err
+		}
+		adc := azuredevops.NewClient(t.Spec.Config.URL, token)
+		adc.Bearer = true
+		return adc, nil
+	}
+
+	return nil, nil
+}
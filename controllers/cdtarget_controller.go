@@ -19,6 +19,7 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/bartvanbenthem/cdtarget-operator/assets"
@@ -29,23 +30,74 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
 	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/sharding"
 )
 
 // CDTargetReconciler reconciles a CDTarget object
 type CDTargetReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// OperatorNamespace is the namespace the operator is installed in,
+	// it contains the cdtarget-ports ConfigMap
+	OperatorNamespace string
+	// OperatorDeployment is the name of the operator Deployment
+	// used to detect an OLM managed installation
+	OperatorDeployment string
+	// Config holds the cluster-wide defaults of the operator
+	Config *operatorconfig.Store
+	// Operands are reconciled after the built-in operands
+	Operands []Operand
+	// MaxConcurrentReconciles is the number of CDTargets reconciled in
+	// parallel, defaults to 1
+	MaxConcurrentReconciles int
+	// Sharding limits the reconciliation to the namespaces of the shards
+	// held by the replica, nil reconciles all namespaces
+	Sharding *sharding.Membership
+
+	tokenChecksMu sync.Mutex
+	tokenChecks   map[types.NamespacedName]tokenCheck
+}
+
+// operatorConfig returns the active operator configuration
+func (r *CDTargetReconciler) operatorConfig() *configv1alpha1.OperatorConfig {
+	if r.Config == nil {
+		return operatorconfig.Default()
+	}
+
+	return r.Config.Get()
+}
+
+// assets returns the loader for the asset manifests, overrides are read
+// from the operator namespace and the configured directory
+func (r *CDTargetReconciler) assets(cfg *configv1alpha1.OperatorConfig) *assets.Loader {
+	return &assets.Loader{
+		Client:    r.Client,
+		Overrides: types.NamespacedName{Name: cfg.Assets.ConfigMapName, Namespace: r.OperatorNamespace},
+		Dir:       cfg.Assets.Directory,
+	}
 }
 
 //+kubebuilder:rbac:groups=cnad.gofound.nl,resources=cdtargets,verbs=get;list;watch;create;update;patch;delete
@@ -53,12 +105,33 @@ type CDTargetReconciler struct {
 //+kubebuilder:rbac:groups=cnad.gofound.nl,resources=cdtargets/finalizers,verbs=update
 //+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=operators.coreos.com,resources=operatorconditions,verbs=get;list;watch
 //+kubebuilder:rbac:groups=keda.sh,resources=scaledobjects,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=keda.sh,resources=triggerauthentications,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=keda.sh,resources=scaledjobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheusrules;podmonitors,verbs=get;list;watch;create;update;patch;delete
+
+// updateStatus writes the status of the CDTarget when it differs from the
+// cached CDTarget, unchanged status writes only load the API server
+func (r *CDTargetReconciler) updateStatus(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	cached := &cnadv1alpha1.CDTarget{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(t), cached)
+	if err == nil && equality.Semantic.DeepEqual(cached.Status, t.Status) {
+		metrics.StatusUpdatesTotal.WithLabelValues("skipped").Inc()
+		return nil
+	}
+
+	metrics.StatusUpdatesTotal.WithLabelValues("written").Inc()
+	return r.Status().Update(ctx, t)
+}
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -71,13 +144,31 @@ type CDTargetReconciler struct {
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.12.2/pkg/reconcile
 func (r *CDTargetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	metrics.ReconcilesTotal.Inc()
+
+	// the namespace is reconciled by the replica that holds its shard
+	if !r.Sharding.Owns(req.Namespace) {
+		return ctrl.Result{}, nil
+	}
+
+	start := time.Now()
+	operatorCR := &cnadv1alpha1.CDTarget{}
+	result, err := r.reconcile(ctx, req, operatorCR)
+	r.recordMetrics(ctx, req, operatorCR, time.Since(start), err)
+
+	return result, err
+}
+
+// reconcile moves the operands of the CDTarget to the desired state, the
+// CDTarget is fetched into operatorCR for the metrics
+func (r *CDTargetReconciler) reconcile(ctx context.Context, req ctrl.Request,
+	operatorCR *cnadv1alpha1.CDTarget) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
 	// Fetch CDTarget object if it exists
-	operatorCR := &cnadv1alpha1.CDTarget{}
 	err := r.Get(ctx, req.NamespacedName, operatorCR)
 	if err != nil && errors.IsNotFound(err) {
 		logger.Info("Operator CDTarget resource object not found.")
+		r.storeTokenCheck(req.NamespacedName, tokenCheck{})
 		return ctrl.Result{}, nil
 	} else if err != nil {
 		logger.Error(err, "Error getting operator CDTarget resource object")
@@ -88,328 +179,65 @@ func (r *CDTargetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			LastTransitionTime: metav1.NewTime(time.Now()),
 			Message:            fmt.Sprintf("unable to get operator custom resource: %s", err.Error()),
 		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.updateStatus(ctx, operatorCR)})
 	}
 
-	// Fetch CDTarget token secret object if it exists
-	// Only if it does not exist create the token secret
-	// so token values can be added later to enable token functionality
-	// the controller is not an owner after initial creation
-	token := &corev1.Secret{}
-	err = r.Get(ctx, types.NamespacedName{Name: operatorCR.Spec.TokenRef,
-		Namespace: operatorCR.Namespace}, token)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Existing Token Secret Not Found")
-		logger.Info("Creating Token Secret, add values later to enable azure pipeline Auth")
-		token = r.tokenSecretForCDTarget(operatorCR)
-		err = r.Create(ctx, token)
-		if err != nil {
-			meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-				Type:               "ReconcileSuccess",
-				Status:             metav1.ConditionFalse,
-				Reason:             cnadv1alpha1.ReasonOperandSecretFailed,
-				LastTransitionTime: metav1.NewTime(time.Now()),
-				Message:            fmt.Sprintf("unable to update operand Token Secret: %s", err.Error()),
-			})
-			return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+	// Deregister the agents from the Azure DevOps agent pool
+	// before the CDTarget and its operands are removed
+	if !operatorCR.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(operatorCR, CDTargetFinalizer) {
+			return ctrl.Result{}, nil
 		}
-	} else if err != nil {
-		logger.Error(err, "Error getting operator CDTarget Token Secret object")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonSecretNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to configure Token Secret: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	// Fetch TriggerAuthentication object if it exists
-	// Only if it does not exist create the TriggerAuthentication
-	// the controller is not an owner after initial creation
-	trigauth := &kedav2.TriggerAuthentication{}
-	err = r.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("%s-trigger-auth", operatorCR.Spec.Config.PoolName),
-		Namespace: operatorCR.Namespace}, trigauth)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Existing TriggerAuthentication Not Found")
-		logger.Info("Creating TriggerAuthentication")
-		trigauth = r.triggerAuthenticationForCDTarget(operatorCR)
-		err = r.Create(ctx, trigauth)
-		if err != nil {
-			meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-				Type:               "ReconcileSuccess",
-				Status:             metav1.ConditionFalse,
-				Reason:             cnadv1alpha1.ReasonOperandTriggerAuthenticationFailed,
-				LastTransitionTime: metav1.NewTime(time.Now()),
-				Message:            fmt.Sprintf("unable to update operand TriggerAuthentication: %s", err.Error()),
-			})
-			return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+		result, err := r.finalizeCDTarget(ctx, operatorCR)
+		if err != nil || !result.IsZero() {
+			return result, err
 		}
-	} else if err != nil {
-		logger.Error(err, "Error getting existing CDTArget TriggerAuthentication.")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonTriggerAuthenticationNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to get operand TriggerAuthentication: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+		controllerutil.RemoveFinalizer(operatorCR, CDTargetFinalizer)
+		return ctrl.Result{}, r.Update(ctx, operatorCR)
 	}
 
-	// Fetch ConfigMap cdtarget-ports object from operator namespace if it exists
-	cmport := &corev1.ConfigMap{}
-	err = r.Get(ctx, types.NamespacedName{Name: "cdtarget-ports",
-		Namespace: "cdtarget-operator"}, cmport)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Existing ConfigMap cdtarget-ports Not Found")
-		logger.Info("Creating ConfigMap cdtarget-ports from assets manifests")
-		cmport = assets.GetConfigMapFromFile("manifests/cdtarget_ports.yaml")
-		err = r.Create(ctx, cmport)
-		if err != nil {
-			meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-				Type:               "ReconcileSuccess",
-				Status:             metav1.ConditionFalse,
-				Reason:             cnadv1alpha1.ReasonOperandConfigMapFailed,
-				LastTransitionTime: metav1.NewTime(time.Now()),
-				Message:            fmt.Sprintf("unable to update operand cdtarget-ports Configmap: %s", err.Error()),
-			})
-			return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+	if !controllerutil.ContainsFinalizer(operatorCR, CDTargetFinalizer) {
+		controllerutil.AddFinalizer(operatorCR, CDTargetFinalizer)
+		if err = r.Update(ctx, operatorCR); err != nil {
+			logger.Error(err, "Failed to add CDTarget finalizer")
+			return ctrl.Result{}, err
 		}
-	} else if err != nil {
-		logger.Error(err, "Error getting operator CDTarget ConfigMap object")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonConfigMapNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to configure ConfigMap cdtarget-ports: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
 	}
 
-	// Fetch NetworkPolicy CDTarget Egress object if it exists
-	netpol := &netv1.NetworkPolicy{}
-	create := false
-	err = r.Get(ctx, types.NamespacedName{Name: operatorCR.Name, Namespace: operatorCR.Namespace}, netpol)
-	if err != nil && errors.IsNotFound(err) {
-		create = true
-	} else if err != nil {
-		logger.Error(err, "Error getting existing CDTArget NetworkPolicy.")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonNetworkPolicyNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to get operand NetworkPolicy: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+	// Only report the operand changes in plan mode
+	if isPlanMode(operatorCR) {
+		return r.planCDTarget(ctx, operatorCR)
 	}
+	operatorCR.Status.Plan = nil
+	operatorCR.Status.PlanGeneration = 0
 
-	// Fetch ports from ConfigMap
-	ports, err := getPortsFromConfigMap(cmport)
-	if err != nil {
-		logger.Error(err, "Failed to parse ports")
+	// Leave the operands untouched while the CDTarget is suspended
+	if isSuspended(operatorCR) {
+		return r.suspendCDTarget(ctx, operatorCR)
 	}
 
-	netpol = r.networkPolicyForCDTarget(operatorCR, ports)
-	if err = ctrl.SetControllerReference(operatorCR, netpol, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set NetworkPolicy controller reference")
+	if err = r.resumeCDTarget(ctx, operatorCR); err != nil {
+		logger.Error(err, "Failed to resume CDTarget")
 		return ctrl.Result{}, err
 	}
 
-	if create {
-		err = r.Create(ctx, netpol)
-	} else {
-		err = r.Update(ctx, netpol)
-	}
+	// Rotate an expiring PAT before it is validated, the agents are
+	// held back while the token is invalid
+	r.reportTokenRotation(operatorCR, r.rotateToken(ctx, operatorCR))
+	tokenRequeue := r.checkToken(ctx, operatorCR)
 
+	// Create or update the operands in order
+	result, err := r.reconcileOperands(ctx, operatorCR)
 	if err != nil {
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonOperandNetworkPolicyFailed,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to update operand NetworkPolicy: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+		return result, err
 	}
 
-	// Fetch NetworkPolicy object azure-pipelines-pool if it exists
-	azp := &netv1.NetworkPolicy{}
-	create = false
-	spoolname := fmt.Sprintf("%s-pool", operatorCR.Name)
-	err = r.Get(ctx, types.NamespacedName{Name: spoolname,
-		Namespace: operatorCR.Namespace}, azp)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info(fmt.Sprintf("Existing NetworkPolicy %s Not Found", spoolname))
-		logger.Info(fmt.Sprintf("Creating NetworkPolicy %s from assets manifests", spoolname))
-		create = true
-	} else if err != nil {
-		logger.Error(err, fmt.Sprintf("Error getting existing CDTArget NetworkPolicy %s.", spoolname))
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonNetworkPolicyNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to get operand NetworkPolicy %s: %s", spoolname, err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+	// revoke the replaced PATs once all operands are ready
+	if result.RequeueAfter == 0 {
+		r.reportTokenRotation(operatorCR, r.revokeRotatedTokens(ctx, operatorCR))
 	}
-
-	azp = assets.GetNetworkPolicyFromFile("manifests/az-pipelines-pool.yaml")
-	azp.ObjectMeta.Name = spoolname
-	azp.ObjectMeta.Namespace = operatorCR.Namespace
-	azp.ObjectMeta.Labels = operatorCR.Spec.AdditionalSelector
-	azp.Spec.PodSelector.MatchLabels = operatorCR.Spec.AdditionalSelector
-	if err = ctrl.SetControllerReference(operatorCR, azp, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set NetworkPolicy controller reference")
-		return ctrl.Result{}, err
-	}
-
-	if create {
-		err = r.Create(ctx, azp)
-	} else {
-		err = r.Update(ctx, azp)
-	}
-
-	if err != nil {
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonOperandNetworkPolicyFailed,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to update operand NetworkPolicy azure-pipelines-pool: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	// Fetch cdtarget-config ConfigMap object if it exists
-	cmcfg := &corev1.ConfigMap{}
-	create = false
-	cfgname := fmt.Sprintf("%s-config", operatorCR.Name)
-	err = r.Get(ctx, types.NamespacedName{Name: cfgname, Namespace: operatorCR.Namespace}, cmcfg)
-	if err != nil && errors.IsNotFound(err) {
-		create = true
-	} else if err != nil {
-		logger.Error(err, "Error getting CDTArget Config")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonConfigMapNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to get operand Config: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	cmcfg = r.configMapForCDTarget(operatorCR)
-	if err = ctrl.SetControllerReference(operatorCR, cmcfg, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set ConfigMap controller reference")
-		return ctrl.Result{}, err
-	}
-
-	if create {
-		err = r.Create(ctx, cmcfg)
-	} else {
-		err = r.Update(ctx, cmcfg)
-	}
-
-	if err != nil {
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonOperandConfigMapFailed,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to update operand ConfigMap: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	// Fetch agent Deployment object if it exists
-	// After creation the Deployment is never updated by the operator
-	// to avoid conflicts with the horizontal pod scaler & KEDA
-	// The operator does own the deployment object for re-creation
-	deployment := &appsv1.Deployment{}
-	create = false
-	err = r.Get(ctx, types.NamespacedName{Name: operatorCR.Name, Namespace: operatorCR.Namespace}, deployment)
-	if err != nil && errors.IsNotFound(err) {
-		create = true
-	} else if err != nil {
-		logger.Error(err, "Error getting CDTArget Agent Deployment.")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonDeploymentNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to get operand Deployment: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	deployment = r.deploymentForCDTarget(operatorCR)
-	if err = ctrl.SetControllerReference(operatorCR, deployment, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set Deployment controller reference")
-		return ctrl.Result{}, err
-	}
-
-	if create {
-		logger.Info(fmt.Sprintf("Creating Deployment %s", deployment.Name))
-		err = r.Create(ctx, deployment)
-	}
-
-	if err != nil {
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonOperandDeploymentFailed,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to create operand Deployment: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	// Fetch ScaledObject if it exists
-	// After creation the ScaledObject is never updated by the operator
-	// The operator does own the ScaledObject object for re-creation
-	so := &kedav2.ScaledObject{}
-	create = false
-	err = r.Get(ctx, types.NamespacedName{Name: operatorCR.Name, Namespace: operatorCR.Namespace}, so)
-	if err != nil && errors.IsNotFound(err) {
-		create = true
-	} else if err != nil {
-		logger.Error(err, "Error getting CDTArget Agent ScaledObject.")
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonScaledObjectNotAvailable,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to get operand ScaledObject: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
-	}
-
-	so = r.scaledObjectForCDTarget(operatorCR)
-	if err = ctrl.SetControllerReference(operatorCR, so, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set ScaledObject controller reference")
-		return ctrl.Result{}, err
-	}
-
-	if create {
-		logger.Info(fmt.Sprintf("Creating ScaledObject %s", so.Name))
-		err = r.Create(ctx, so)
-	}
-
-	if err != nil {
-		meta.SetStatusCondition(&operatorCR.Status.Conditions, metav1.Condition{
-			Type:               "ReconcileSuccess",
-			Status:             metav1.ConditionFalse,
-			Reason:             cnadv1alpha1.ReasonOperandScaledObjectFailed,
-			LastTransitionTime: metav1.NewTime(time.Now()),
-			Message:            fmt.Sprintf("unable to create operand ScaledObject: %s", err.Error()),
-		})
-		return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+	if tokenRequeue > 0 && (result.RequeueAfter == 0 || tokenRequeue < result.RequeueAfter) {
+		result.RequeueAfter = tokenRequeue
 	}
 
 	// Finalize reconcile loop and set succesfull status condition
@@ -420,14 +248,14 @@ func (r *CDTargetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		LastTransitionTime: metav1.NewTime(time.Now()),
 		Message:            "operator successfully reconciling",
 	})
-	r.Status().Update(ctx, operatorCR)
-
 	// OLM condition reporting
 	cdo := &appsv1.Deployment{}
-	err = r.Get(ctx, types.NamespacedName{Name: "cdtarget-controller-manager",
-		Namespace: "cdtarget-operator"}, cdo)
+	err = r.Get(ctx, types.NamespacedName{Name: r.OperatorDeployment,
+		Namespace: r.OperatorNamespace}, cdo)
 	if err != nil && errors.IsNotFound(err) {
-		logger.Info("cdtarget-controller-manager not found")
+		// not installed as a Deployment, no OLM condition to report
+		logger.V(1).Info(fmt.Sprintf("%s not found", r.OperatorDeployment))
+		err = nil
 	} else if err != nil {
 		logger.Error(err, "Error fetching CDTarget operator deployment")
 	}
@@ -448,18 +276,136 @@ func (r *CDTargetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
-	return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.Status().Update(ctx, operatorCR)})
+	// requeue earlier while an operand is not ready
+	requeue := r.operatorConfig().Resync.ReconcileInterval.Duration
+	if result.RequeueAfter > 0 && (requeue == 0 || result.RequeueAfter < requeue) {
+		requeue = result.RequeueAfter
+	}
+
+	return ctrl.Result{RequeueAfter: requeue},
+		utilerrors.NewAggregate([]error{err, r.updateStatus(ctx, operatorCR)})
 
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CDTargetReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&cnadv1alpha1.CDTarget{}).
-		Owns(&netv1.NetworkPolicy{}).
-		Owns(&appsv1.Deployment{}).
+	// index the referenced Secrets and ConfigMaps so their changes can be
+	// mapped back to the CDTargets that consume them
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &cnadv1alpha1.CDTarget{},
+		secretRefIndex, func(obj client.Object) []string {
+			return secretRefsForCDTarget(obj.(*cnadv1alpha1.CDTarget))
+		})
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &cnadv1alpha1.CDTarget{},
+		configMapRefIndex, func(obj client.Object) []string {
+			return configMapRefsForCDTarget(obj.(*cnadv1alpha1.CDTarget))
+		})
+	if err != nil {
+		return err
+	}
+
+	// ignore status only updates, the status writes of the operator
+	// and the operand status changes during scaling would requeue the
+	// CDTarget, the annotations switch the suspend and plan modes
+	cdtargetChanged := predicate.Or(
+		predicate.GenerationChangedPredicate{},
+		predicate.AnnotationChangedPredicate{},
+		predicate.Funcs{UpdateFunc: func(e event.UpdateEvent) bool {
+			return !e.ObjectNew.GetDeletionTimestamp().IsZero()
+		}},
+	)
+	specChanged := builder.WithPredicates(predicate.GenerationChangedPredicate{})
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		For(&cnadv1alpha1.CDTarget{}, builder.WithPredicates(cdtargetChanged)).
+		Owns(&netv1.NetworkPolicy{}, specChanged).
+		Owns(&appsv1.Deployment{}, specChanged).
+		Owns(&appsv1.StatefulSet{}, specChanged).
 		Owns(&corev1.ConfigMap{}).
-		Owns(&kedav2.ScaledObject{}).
-		Owns(&kedav2.TriggerAuthentication{}).
-		Complete(r)
+		Owns(&corev1.ServiceAccount{}).
+		Owns(&corev1.Service{}).
+		Owns(&kedav2.ScaledObject{}, specChanged).
+		Owns(&kedav2.ScaledJob{}, specChanged).
+		Owns(&kedav2.TriggerAuthentication{}, specChanged).
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.cdTargetsForSecret)).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.cdTargetsForConfigMap))
+
+	// the events of a namespace are dropped while another replica holds
+	// its shard, the CDTargets are requeued when the shard is acquired
+	if r.Sharding != nil {
+		acquired := make(chan event.GenericEvent)
+		r.Sharding.OnAcquire(func(ctx context.Context, shard int) {
+			r.enqueueShard(ctx, shard, acquired)
+		})
+		b = b.Watches(&source.Channel{Source: acquired}, &handler.EnqueueRequestForObject{})
+
+		// the replica that acquires the shard exports the series of its
+		// CDTargets, the stale series of this replica are removed so the
+		// alerts on the series do not fire for the released namespaces
+		r.Sharding.OnRelease(r.deleteShardMetrics)
+	}
+
+	// the operands of all CDTargets depend on the operator configuration,
+	// they are requeued when a changed configuration file is reloaded
+	if r.Config != nil {
+		reloaded := make(chan event.GenericEvent)
+		r.Config.OnReload(func(ctx context.Context) {
+			r.enqueueCDTargets(ctx, reloaded, func(*cnadv1alpha1.CDTarget) bool { return true })
+		})
+		b = b.Watches(&source.Channel{Source: reloaded}, &handler.EnqueueRequestForObject{})
+	}
+
+	return b.Complete(r)
+}
+
+// deleteShardMetrics removes the metric series of the namespaces of the shard
+func (r *CDTargetReconciler) deleteShardMetrics(ctx context.Context, shard int) {
+	list := &cnadv1alpha1.CDTargetList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "Error listing CDTargets of released shard", "shard", shard)
+		return
+	}
+
+	namespaces := map[string]bool{}
+	for i := range list.Items {
+		ns := list.Items[i].Namespace
+		if r.Sharding.ShardFor(ns) == shard && !namespaces[ns] {
+			namespaces[ns] = true
+			metrics.DeleteNamespace(ns)
+		}
+	}
+}
+
+// enqueueShard requeues the CDTargets in the namespaces of the shard
+func (r *CDTargetReconciler) enqueueShard(ctx context.Context, shard int, events chan<- event.GenericEvent) {
+	r.enqueueCDTargets(ctx, events, func(t *cnadv1alpha1.CDTarget) bool {
+		return r.Sharding.ShardFor(t.Namespace) == shard
+	})
+}
+
+// enqueueCDTargets requeues the CDTargets that match
+func (r *CDTargetReconciler) enqueueCDTargets(ctx context.Context, events chan<- event.GenericEvent,
+	match func(t *cnadv1alpha1.CDTarget) bool) {
+
+	list := &cnadv1alpha1.CDTargetList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "Error listing CDTargets to requeue")
+		return
+	}
+
+	for i := range list.Items {
+		if !match(&list.Items[i]) {
+			continue
+		}
+		select {
+		case events <- event.GenericEvent{Object: &list.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
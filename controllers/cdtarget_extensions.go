@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"fmt"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	dindContainerName = "dind"
+	dindSocketVolume  = "dind-socket"
+	dindStorageVolume = "dind-storage"
+	dindSocketDir     = "/var/run/dind"
+)
+
+// agentExtension is a spec field that adds containers or volumes to the
+// agent pod, the extensions can bypass the Pod Security Standards and have
+// to be listed in podTemplate.allowedFields
+type agentExtension struct {
+	name string
+	set  func(t *cnadv1alpha1.CDTarget) bool
+}
+
+var agentExtensions = []agentExtension{
+	{"sidecars", func(t *cnadv1alpha1.CDTarget) bool { return len(t.Spec.Sidecars) > 0 }},
+	{"initContainers", func(t *cnadv1alpha1.CDTarget) bool { return len(t.Spec.InitContainers) > 0 }},
+	{"volumes", func(t *cnadv1alpha1.CDTarget) bool {
+		return len(t.Spec.Volumes) > 0 || len(t.Spec.VolumeMounts) > 0
+	}},
+	{"dind", func(t *cnadv1alpha1.CDTarget) bool { return t.Spec.DinD }},
+}
+
+// addAgentExtensions adds the allowed sidecars, init containers, volumes and
+// volume mounts of the CDTarget and the Docker-in-Docker preset to the agent
+// pod, extensions that are not allowed are skipped
+func (r *CDTargetReconciler) addAgentExtensions(t *cnadv1alpha1.CDTarget, spec *corev1.PodSpec) {
+	if t.Spec.DinD && r.allowedPodTemplateField("dind") {
+		addDinD(t, spec, r.operatorConfig().DinDImage, r.allowedPodTemplateField("sidecars"))
+	}
+
+	if r.allowedPodTemplateField("sidecars") {
+		spec.Containers = append(spec.Containers, t.Spec.Sidecars...)
+	}
+	if r.allowedPodTemplateField("initContainers") {
+		spec.InitContainers = append(spec.InitContainers, t.Spec.InitContainers...)
+	}
+	if !r.allowedPodTemplateField("volumes") {
+		return
+	}
+	spec.Volumes = append(spec.Volumes, t.Spec.Volumes...)
+
+	for i, container := range spec.Containers {
+		if container.Name == "agent" {
+			spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts, t.Spec.VolumeMounts...)
+		}
+	}
+}
+
+// validateJobExtensions rejects sidecars in job mode, a sidecar keeps
+// running after the agent exits so the agent Job never completes
+func validateJobExtensions(t *cnadv1alpha1.CDTarget) error {
+	if t.Spec.DinD || len(t.Spec.Sidecars) > 0 {
+		return &OperandError{Reason: cnadv1alpha1.ReasonSidecarsNotSupported,
+			Message: "invalid job mode configuration",
+			Err:     fmt.Errorf("dind and sidecars are not supported with %s mode", cnadv1alpha1.ModeJob)}
+	}
+
+	return nil
+}
+
+// addDinD adds a privileged Docker daemon sidecar that listens on a socket in
+// a volume shared with the agent, an allowed sidecar named dind in
+// spec.sidecars replaces the preset container
+func addDinD(t *cnadv1alpha1.CDTarget, spec *corev1.PodSpec, image string, sidecarsAllowed bool) {
+	socket := fmt.Sprintf("unix://%s/docker.sock", dindSocketDir)
+
+	spec.Volumes = append(spec.Volumes,
+		corev1.Volume{Name: dindSocketVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		corev1.Volume{Name: dindStorageVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	)
+
+	for i, container := range spec.Containers {
+		if container.Name == "agent" {
+			spec.Containers[i].Env = append(spec.Containers[i].Env, corev1.EnvVar{Name: "DOCKER_HOST", Value: socket})
+			spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts,
+				corev1.VolumeMount{Name: dindSocketVolume, MountPath: dindSocketDir})
+		}
+	}
+
+	for _, sidecar := range t.Spec.Sidecars {
+		if sidecar.Name == dindContainerName && sidecarsAllowed {
+			return
+		}
+	}
+
+	args := []string{"--host=" + socket}
+	if len(t.Spec.Config.MTUValue) > 0 {
+		args = append(args, "--mtu="+t.Spec.Config.MTUValue)
+	}
+
+	spec.Containers = append(spec.Containers, corev1.Container{
+		Name:  dindContainerName,
+		Image: image,
+		Args:  args,
+		Env: []corev1.EnvVar{
+			// disable TLS, the daemon only listens on the shared socket
+			{Name: "DOCKER_TLS_CERTDIR", Value: ""},
+		},
+		SecurityContext: &corev1.SecurityContext{Privileged: boolPointer(true)},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: dindSocketVolume, MountPath: dindSocketDir},
+			{Name: dindStorageVolume, MountPath: "/var/lib/docker"},
+		},
+	})
+}
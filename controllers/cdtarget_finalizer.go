@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// CDTargetFinalizer deregisters the agents of a CDTarget from the
+	// Azure DevOps agent pool before the CDTarget is removed
+	CDTargetFinalizer = "cnad.gofound.nl/finalizer"
+
+	// SkipDeregistrationAnnotation releases the finalizer without removing
+	// the agents from the agent pool when set to "true"
+	SkipDeregistrationAnnotation = "cnad.gofound.nl/skip-agent-deregistration"
+
+	// agentOwnerEnv is set to the CDTarget uid in the agent container, the
+	// agent reports it as system capability so the operator only removes
+	// agents registered by pods of the CDTarget
+	agentOwnerEnv = "CNAD_CDTARGET_UID"
+
+	// deregistrationTimeout is the time after the deletion of a CDTarget
+	// after which the finalizer is released while Azure DevOps is not reachable
+	deregistrationTimeout = 15 * time.Minute
+)
+
+// agentMatchesCDTarget reports if the agent was registered by an agent pod
+// of the CDTarget, agents registered before the owner capability was set
+// are matched by the configured agent name or the pod names of the CDTarget
+func agentMatchesCDTarget(t *cnadv1alpha1.CDTarget, agent azuredevops.Agent) bool {
+	if len(t.UID) == 0 {
+		return false
+	}
+	if owner, ok := agent.SystemCapabilities[agentOwnerEnv]; ok {
+		return owner == string(t.UID)
+	}
+
+	return (len(t.Spec.Config.AgentName) > 0 && agent.Name == t.Spec.Config.AgentName) ||
+		agentPodName(t).MatchString(agent.Name)
+}
+
+// agentPodName matches the names of the agent pods of the Deployment, the
+// Jobs of the ScaledJob and the StatefulSet of the CDTarget, the agents are
+// named after their pod unless an agent name is configured
+func agentPodName(t *cnadv1alpha1.CDTarget) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(t.Name) + `-([a-z0-9]{5,10}-[a-z0-9]{5}|[0-9]+)$`)
+}
+
+// finalizeCDTarget scales the agents down gracefully and removes the agents
+// that are still registered in the agent pool, the returned Result requests
+// a requeue while agent pods are terminating
+func (r *CDTargetReconciler) finalizeCDTarget(ctx context.Context, t *cnadv1alpha1.CDTarget) (ctrl.Result, error) {
+	// remove the ScaledObject and scale the agents down through the
+	// operand cleanup, requeue while agent pods are terminating
+	done, err := r.cleanupOperands(ctx, t)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !done {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	if t.Annotations[SkipDeregistrationAnnotation] == "true" {
+		r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonAgentDeregistrationFailed,
+			"agent deregistration skipped by the %s annotation, agents in pool %s are not removed",
+			SkipDeregistrationAnnotation, t.Spec.Config.PoolName)
+		return ctrl.Result{}, nil
+	}
+
+	// remove the agents that did not deregister themselves
+	adc, err := clientForCDTarget(ctx, r.Client, t)
+	if err != nil && !errors.IsNotFound(err) {
+		return r.deregistrationFailed(t, err)
+	}
+
+	if adc == nil {
+		r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonAgentDeregistrationFailed,
+			"no Azure DevOps credentials for %s auth, agents in pool %s are not deregistered",
+			authType(t), t.Spec.Config.PoolName)
+		return ctrl.Result{}, nil
+	}
+
+	deleted, err := adc.DeleteAgents(ctx, t.Spec.Config.PoolName, func(agent azuredevops.Agent) bool {
+		return agentMatchesCDTarget(t, agent)
+	})
+	if err != nil {
+		r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonAgentDeregistrationFailed,
+			"unable to deregister agents from pool %s: %s", t.Spec.Config.PoolName, err.Error())
+		return r.deregistrationFailed(t, err)
+	}
+
+	if len(deleted) > 0 {
+		r.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonAgentsDeregistered,
+			"deregistered %d agents from pool %s: %s", len(deleted), t.Spec.Config.PoolName, strings.Join(deleted, ", "))
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// deregistrationFailed retries the deregistration until the timeout passed
+// since the deletion of the CDTarget, the finalizer is then released so an
+// unreachable Azure DevOps does not block the deletion
+func (r *CDTargetReconciler) deregistrationFailed(t *cnadv1alpha1.CDTarget, err error) (ctrl.Result, error) {
+	if t.DeletionTimestamp == nil || time.Since(t.DeletionTimestamp.Time) < deregistrationTimeout {
+		return ctrl.Result{}, err
+	}
+
+	r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonAgentDeregistrationFailed,
+		"agent deregistration from pool %s failed for %s, the finalizer is released: %s",
+		t.Spec.Config.PoolName, deregistrationTimeout, err.Error())
+	return ctrl.Result{}, nil
+}
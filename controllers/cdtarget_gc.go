@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/metrics"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/sharding"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// StaleAgentCollector periodically removes the agents of each CDTarget
+// that are offline for longer than the maximum offline age and no longer have a
+// running agent pod, for example after the pod crashed or was OOM-killed
+// before the agent cleanup trap could run
+type StaleAgentCollector struct {
+	client.Client
+	Recorder record.EventRecorder
+	// Config provides the sweep interval and the maximum offline age,
+	// a zero sweep interval disables the collector
+	Config *operatorconfig.Store
+	// Sharding limits the sweep to the namespaces of the shards held by
+	// the replica, nil sweeps all namespaces
+	Sharding *sharding.Membership
+}
+
+// Start runs the sweep every sweep interval until the context is cancelled,
+// it implements the controller-runtime manager Runnable interface
+func (c *StaleAgentCollector) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("stale-agent-collector")
+
+	for {
+		interval := c.Config.Get().Resync.StaleAgentSweepInterval.Duration
+		enabled := interval > 0
+		if !enabled {
+			// check again later, the configuration can be reloaded
+			interval = operatorconfig.DefaultConfigReloadInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+			if !enabled {
+				continue
+			}
+			list := &cnadv1alpha1.CDTargetList{}
+			if err := c.List(ctx, list); err != nil {
+				logger.Error(err, "Error listing CDTargets")
+				continue
+			}
+			for i := range list.Items {
+				t := &list.Items[i]
+				if !t.DeletionTimestamp.IsZero() || isSuspended(t) || !c.Sharding.Owns(t.Namespace) {
+					continue
+				}
+				if err := c.sweepCDTarget(ctx, t); err != nil {
+					logger.Error(err, "Error removing stale agents",
+						"namespace", t.Namespace, "cdtarget", t.Name)
+				}
+			}
+		}
+	}
+}
+
+// sweepCDTarget removes the stale agents of a single CDTarget
+func (c *StaleAgentCollector) sweepCDTarget(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	adc, err := clientForCDTarget(ctx, c.Client, t)
+	if err != nil || adc == nil {
+		// without credentials the agents can not be listed, the
+		// reconciler already reports the missing token
+		return nil
+	}
+
+	pods := &corev1.PodList{}
+	err = c.List(ctx, pods, client.InNamespace(t.Namespace),
+		client.MatchingLabels(t.Spec.AdditionalSelector))
+	if err != nil {
+		return err
+	}
+
+	live := map[string]bool{}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp.IsZero() {
+			live[pod.Name] = true
+		}
+	}
+
+	now := time.Now()
+	maxAge := c.Config.Get().Resync.StaleAgentMaxAge.Duration
+	// DeleteAgents skips the online agents, agents of other CDTargets in the
+	// pool are not matched by the owner capability or the pod names
+	deleted, err := adc.DeleteAgents(ctx, t.Spec.Config.PoolName, func(agent azuredevops.Agent) bool {
+		if !agentMatchesCDTarget(t, agent) {
+			return false
+		}
+		// agents share the configured name, any live pod may own it
+		if len(t.Spec.Config.AgentName) > 0 && len(live) > 0 {
+			return false
+		}
+		return !live[agent.Name] && now.Sub(agent.StatusChangedOn) > maxAge
+	})
+
+	if len(deleted) > 0 {
+		metrics.StaleAgentsRemovedTotal.WithLabelValues(t.Namespace, t.Name).Add(float64(len(deleted)))
+		c.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonStaleAgentsRemoved,
+			"removed %d stale offline agents from pool %s: %s",
+			len(deleted), t.Spec.Config.PoolName, strings.Join(deleted, ", "))
+	}
+
+	if err != nil {
+		c.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonAgentDeregistrationFailed,
+			"unable to remove stale agents from pool %s: %s", t.Spec.Config.PoolName, err.Error())
+	}
+
+	patch := client.MergeFrom(t.DeepCopy())
+	sweep := metav1.NewTime(now)
+	t.Status.LastStaleAgentSweepTime = &sweep
+	t.Status.StaleAgentsRemoved += int32(len(deleted))
+	if perr := c.Status().Patch(ctx, t, patch); perr != nil {
+		return fmt.Errorf("unable to update status: %w", perr)
+	}
+
+	return err
+}
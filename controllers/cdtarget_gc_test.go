@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// agentPool serves the pools and agents endpoints of the build agent pool
+// and records the names of the deleted agents
+type agentPool struct {
+	mu      sync.Mutex
+	agents  []azuredevops.Agent
+	deleted []string
+}
+
+func (p *agentPool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	const agentsPath = "/org/_apis/distributedtask/pools/7/agents"
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/org/_apis/distributedtask/pools":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"count": 1, "value": []map[string]interface{}{{"id": 7, "name": "build"}}})
+	case req.Method == http.MethodGet && req.URL.Path == agentsPath:
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(p.agents), "value": p.agents})
+	case req.Method == http.MethodDelete:
+		for i, agent := range p.agents {
+			if req.URL.Path == agentsPath+"/"+strconv.Itoa(agent.ID) {
+				p.deleted = append(p.deleted, agent.Name)
+				p.agents = append(p.agents[:i], p.agents[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := cnadv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	return scheme
+}
+
+func TestSweepCDTarget(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	owner := func(uid string) map[string]string { return map[string]string{agentOwnerEnv: uid} }
+	pool := &agentPool{agents: []azuredevops.Agent{
+		{ID: 1, Name: "cdtarget-5d8f7c9b4-abcde", Status: "offline", StatusChangedOn: old},
+		{ID: 2, Name: "cdtarget-0", Status: "offline", StatusChangedOn: old},
+		{ID: 3, Name: "renamed", Status: "offline", StatusChangedOn: old, SystemCapabilities: owner("uid-a")},
+		// agents of other CDTargets in the pool
+		{ID: 4, Name: "cdtarget-5d8f7c9b4-fghij", Status: "offline", StatusChangedOn: old,
+			SystemCapabilities: owner("uid-b")},
+		{ID: 5, Name: "cdtarget-b-5d8f7c9b4-abcde", Status: "offline", StatusChangedOn: old},
+		// a live pod, an online agent and a recently stopped agent
+		{ID: 6, Name: "cdtarget-5d8f7c9b4-klmno", Status: "offline", StatusChangedOn: old},
+		{ID: 7, Name: "cdtarget-5d8f7c9b4-pqrst", Status: "online", StatusChangedOn: old},
+		{ID: 8, Name: "cdtarget-5d8f7c9b4-uvwxy", Status: "offline", StatusChangedOn: time.Now()},
+	}}
+	server := httptest.NewServer(pool)
+	defer server.Close()
+
+	target := &cnadv1alpha1.CDTarget{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Namespace: "test", UID: "uid-a"},
+		Spec: cnadv1alpha1.CDTargetSpec{
+			TokenRef: "cdtarget-token",
+			Config:   cnadv1alpha1.AgentConfig{URL: server.URL + "/org/", PoolName: "build"},
+		},
+	}
+	token := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-token", Namespace: "test"},
+		Data:       map[string][]byte{"AZP_TOKEN": []byte("pat")},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-5d8f7c9b4-klmno", Namespace: "test"}}
+
+	store, err := operatorconfig.NewStore("", &configv1alpha1.OperatorConfig{
+		Resync: configv1alpha1.ResyncConfig{StaleAgentMaxAge: &metav1.Duration{Duration: time.Hour}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &StaleAgentCollector{
+		Client:   fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(target, token, pod).Build(),
+		Recorder: record.NewFakeRecorder(10),
+		Config:   store,
+	}
+
+	ctx := context.Background()
+	if err := c.sweepCDTarget(ctx, target); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(pool.deleted)
+	want := []string{"cdtarget-0", "cdtarget-5d8f7c9b4-abcde", "renamed"}
+	if !reflect.DeepEqual(pool.deleted, want) {
+		t.Errorf("deleted agents = %v, want %v", pool.deleted, want)
+	}
+
+	live := &cnadv1alpha1.CDTarget{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(target), live); err != nil {
+		t.Fatal(err)
+	}
+	if live.Status.StaleAgentsRemoved != 3 || live.Status.LastStaleAgentSweepTime == nil {
+		t.Errorf("status not updated: %d agents removed, last sweep %v",
+			live.Status.StaleAgentsRemoved, live.Status.LastStaleAgentSweepTime)
+	}
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/metrics"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reasonReconcileError is the metrics reason of a failed reconcile that did
+// not set the ReconcileSuccess condition
+const reasonReconcileError = "ReconcileError"
+
+// kedaScaledJobLabel is set by KEDA on the Jobs of a ScaledJob
+const kedaScaledJobLabel = "scaledjob.keda.sh/name"
+
+// recordMetrics updates the per CDTarget metrics after a reconcile, the
+// series of a deleted CDTarget are removed
+func (r *CDTargetReconciler) recordMetrics(ctx context.Context, req ctrl.Request,
+	t *cnadv1alpha1.CDTarget, duration time.Duration, err error) {
+	if err == nil && (len(t.ResourceVersion) == 0 || !t.DeletionTimestamp.IsZero()) {
+		metrics.DeleteCDTarget(req.Namespace, req.Name)
+		return
+	}
+
+	metrics.ReconcileDurationSeconds.WithLabelValues(req.Namespace, req.Name).Observe(duration.Seconds())
+
+	if err != nil {
+		reason := reasonReconcileError
+		if c := meta.FindStatusCondition(t.Status.Conditions, "ReconcileSuccess"); c != nil &&
+			c.Status == metav1.ConditionFalse {
+			reason = c.Reason
+		}
+		metrics.ReconcileErrorsTotal.WithLabelValues(req.Namespace, req.Name, reason).Inc()
+		return
+	}
+
+	if !isPlanMode(t) && !isSuspended(t) &&
+		meta.IsStatusConditionTrue(t.Status.Conditions, "ReconcileSuccess") {
+		metrics.LastSuccessfulReconcileTimestamp.WithLabelValues(req.Namespace, req.Name).SetToCurrentTime()
+	}
+
+	netpol := &netv1.NetworkPolicy{}
+	if err := r.Get(ctx, ownedKey(t), netpol); err == nil {
+		ips, ports := egressOfNetworkPolicy(netpol)
+		metrics.EgressIPs.WithLabelValues(req.Namespace, req.Name).Set(float64(ips))
+		metrics.EgressPorts.WithLabelValues(req.Namespace, req.Name).Set(float64(ports))
+	}
+
+	switch agentMode(t) {
+	case cnadv1alpha1.ModeDeployment:
+		deploy := &appsv1.Deployment{}
+		if err := r.Get(ctx, ownedKey(t), deploy); err == nil {
+			metrics.AgentReplicas.WithLabelValues(req.Namespace, req.Name).Set(float64(deploy.Status.Replicas))
+		}
+	case cnadv1alpha1.ModeStateful:
+		sts := &appsv1.StatefulSet{}
+		if err := r.Get(ctx, ownedKey(t), sts); err == nil {
+			metrics.AgentReplicas.WithLabelValues(req.Namespace, req.Name).Set(float64(sts.Status.Replicas))
+		}
+	case cnadv1alpha1.ModeJob:
+		// KEDA labels the Jobs of a ScaledJob with its name
+		jobs := &batchv1.JobList{}
+		if err := r.List(ctx, jobs, client.InNamespace(req.Namespace),
+			client.MatchingLabels{kedaScaledJobLabel: req.Name}); err == nil {
+			active := int32(0)
+			for _, job := range jobs.Items {
+				active += job.Status.Active
+			}
+			metrics.AgentReplicas.WithLabelValues(req.Namespace, req.Name).Set(float64(active))
+		}
+	}
+}
+
+// egressOfNetworkPolicy returns the number of IP blocks and distinct ports
+// the NetworkPolicy allows as egress
+func egressOfNetworkPolicy(netpol *netv1.NetworkPolicy) (int, int) {
+	ips := map[string]bool{}
+	ports := map[string]bool{}
+	for _, rule := range netpol.Spec.Egress {
+		for _, peer := range rule.To {
+			if peer.IPBlock != nil {
+				ips[peer.IPBlock.CIDR] = true
+			}
+		}
+		for _, port := range rule.Ports {
+			if port.Port != nil {
+				ports[port.Port.String()] = true
+			}
+		}
+	}
+
+	return len(ips), len(ports)
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"fmt"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// the Prometheus operator types are handled as unstructured objects, the
+// operator does not depend on the Prometheus operator API and only needs its
+// CRDs when spec.monitoring is used
+var (
+	prometheusRuleGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule"}
+	podMonitorGVK     = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PodMonitor"}
+)
+
+// newMonitoringObject returns an empty unstructured object of the kind
+func newMonitoringObject(gvk schema.GroupVersionKind) client.Object {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	return u
+}
+
+func prometheusRuleEnabled(t *cnadv1alpha1.CDTarget) bool {
+	return t.Spec.Monitoring != nil && t.Spec.Monitoring.Enabled
+}
+
+func podMonitorEnabled(t *cnadv1alpha1.CDTarget) bool {
+	return prometheusRuleEnabled(t) && t.Spec.Monitoring.PodMonitor != nil
+}
+
+// monitoringLabels returns the labels of the monitoring resources
+func monitoringLabels(t *cnadv1alpha1.CDTarget) map[string]string {
+	labels := map[string]string{}
+	for k, v := range t.Spec.AdditionalSelector {
+		labels[k] = v
+	}
+	for k, v := range t.Spec.Monitoring.Labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// alertRule returns a Prometheus alerting rule for the agents of the CDTarget
+func alertRule(t *cnadv1alpha1.CDTarget, alert, expr, duration, severity, summary string) interface{} {
+	return map[string]interface{}{
+		"alert": alert,
+		"expr":  expr,
+		"for":   duration,
+		"labels": map[string]interface{}{
+			"severity": severity,
+			"cdtarget": t.Name,
+		},
+		"annotations": map[string]interface{}{
+			"summary": summary,
+		},
+	}
+}
+
+// noReadyAgentsExpr returns the expression of the CDTargetNoReadyAgents
+// alert for the agent workload of the mode, empty in job mode without
+// minReplicaCount as no agent Job is expected to run
+func noReadyAgentsExpr(t *cnadv1alpha1.CDTarget) string {
+	ns, name := t.Namespace, t.Name
+
+	switch agentMode(t) {
+	case cnadv1alpha1.ModeStateful:
+		return fmt.Sprintf(`kube_statefulset_replicas{namespace="%s",statefulset="%s"} > 0 and `+
+			`kube_statefulset_status_replicas_ready{namespace="%s",statefulset="%s"} == 0`, ns, name, ns, name)
+	case cnadv1alpha1.ModeJob:
+		if t.Spec.MinReplicaCount == nil || *t.Spec.MinReplicaCount == 0 {
+			return ""
+		}
+		return fmt.Sprintf(`(sum(kube_job_status_active{namespace="%s"} * on(namespace, job_name) group_left() `+
+			`kube_job_owner{namespace="%s",owner_kind="ScaledJob",owner_name="%s"}) or vector(0)) == 0`, ns, ns, name)
+	}
+
+	return fmt.Sprintf(`kube_deployment_spec_replicas{namespace="%s",deployment="%s"} > 0 and `+
+		`kube_deployment_status_replicas_available{namespace="%s",deployment="%s"} == 0`, ns, name, ns, name)
+}
+
+// scalerErrorsExpr returns the expression of the CDTargetScalerErrors alert
+// on the keda_scaler_errors metric of the KEDA operator, the errors of a
+// ScaledJob are labelled with scaledJob instead of scaledObject. The KEDA
+// metrics are scraped without honorLabels in most setups, the namespace
+// label is then renamed to exported_namespace
+func scalerErrorsExpr(t *cnadv1alpha1.CDTarget) string {
+	ns, name := t.Namespace, t.Name
+	label := "scaledObject"
+	if agentMode(t) == cnadv1alpha1.ModeJob {
+		label = "scaledJob"
+	}
+
+	return fmt.Sprintf(`increase(keda_scaler_errors{namespace="%s",%s="%s"}[10m]) > 0 or `+
+		`increase(keda_scaler_errors{exported_namespace="%s",%s="%s"}[10m]) > 0`,
+		ns, label, name, ns, label, name)
+}
+
+func prometheusRuleForCDTarget(t *cnadv1alpha1.CDTarget) *unstructured.Unstructured {
+	ns, name := t.Namespace, t.Name
+	var rules []interface{}
+	if expr := noReadyAgentsExpr(t); len(expr) > 0 {
+		rules = append(rules, alertRule(t, "CDTargetNoReadyAgents", expr, "15m", "critical",
+			fmt.Sprintf("CDTarget %s/%s has no ready agents", ns, name)))
+	}
+	rules = append(rules,
+		alertRule(t, "CDTargetScalerErrors", scalerErrorsExpr(t),
+			"10m", "warning",
+			fmt.Sprintf("KEDA scaler of CDTarget %s/%s reports errors", ns, name)),
+		alertRule(t, "CDTargetReconcileStale",
+			fmt.Sprintf(`time() - cdtarget_last_successful_reconcile_timestamp_seconds{namespace="%s",cdtarget="%s"} > 3600`,
+				ns, name),
+			"15m", "warning",
+			fmt.Sprintf("CDTarget %s/%s was not reconciled successfully in the last hour", ns, name)),
+	)
+
+	u := newMonitoringObject(prometheusRuleGVK).(*unstructured.Unstructured)
+	u.SetName(name)
+	u.SetNamespace(ns)
+	u.SetLabels(monitoringLabels(t))
+	u.Object["spec"] = map[string]interface{}{
+		"groups": []interface{}{
+			map[string]interface{}{
+				"name":  fmt.Sprintf("cdtarget-%s-%s", ns, name),
+				"rules": rules,
+			},
+		},
+	}
+
+	return u
+}
+
+func podMonitorForCDTarget(t *cnadv1alpha1.CDTarget) *unstructured.Unstructured {
+	pm := t.Spec.Monitoring.PodMonitor
+	endpoint := map[string]interface{}{
+		"port": pm.Port,
+		"path": "/metrics",
+	}
+	if len(pm.Path) > 0 {
+		endpoint["path"] = pm.Path
+	}
+	if len(pm.Interval) > 0 {
+		endpoint["interval"] = pm.Interval
+	}
+
+	selector := map[string]interface{}{}
+	for k, v := range t.Spec.AdditionalSelector {
+		selector[k] = v
+	}
+
+	u := newMonitoringObject(podMonitorGVK).(*unstructured.Unstructured)
+	u.SetName(t.Name)
+	u.SetNamespace(t.Namespace)
+	u.SetLabels(monitoringLabels(t))
+	u.Object["spec"] = map[string]interface{}{
+		"selector":            map[string]interface{}{"matchLabels": selector},
+		"podMetricsEndpoints": []interface{}{endpoint},
+	}
+
+	return u
+}
+
+// updateMonitoringObject applies the desired labels and spec
+func updateMonitoringObject(live, desired client.Object) bool {
+	l, d := live.(*unstructured.Unstructured), desired.(*unstructured.Unstructured)
+	if equality.Semantic.DeepEqual(l.GetLabels(), d.GetLabels()) &&
+		equality.Semantic.DeepEqual(l.Object["spec"], d.Object["spec"]) {
+		return false
+	}
+
+	l.SetLabels(d.GetLabels())
+	l.Object["spec"] = d.Object["spec"]
+	return true
+}
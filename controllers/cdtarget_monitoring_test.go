@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+)
+
+func TestScalerErrorsExpr(t *testing.T) {
+	tests := []struct {
+		mode  string
+		label string
+	}{
+		{mode: cnadv1alpha1.ModeDeployment, label: `scaledObject="cdtarget"`},
+		{mode: cnadv1alpha1.ModeStateful, label: `scaledObject="cdtarget"`},
+		{mode: cnadv1alpha1.ModeJob, label: `scaledJob="cdtarget"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			target := &cnadv1alpha1.CDTarget{Spec: cnadv1alpha1.CDTargetSpec{Mode: tt.mode}}
+			target.Name, target.Namespace = "cdtarget", "test"
+
+			expr := scalerErrorsExpr(target)
+			if strings.Count(expr, "keda_scaler_errors{") != 2 || strings.Count(expr, tt.label) != 2 {
+				t.Errorf("scalerErrorsExpr() = %s, want keda_scaler_errors with %s", expr, tt.label)
+			}
+		})
+	}
+}
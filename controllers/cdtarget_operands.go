@@ -0,0 +1,657 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/assets"
+	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// agentWorkloadKind returns the kind of the agent workload scaled by KEDA
+func agentWorkloadKind(t *cnadv1alpha1.CDTarget) string {
+	switch agentMode(t) {
+	case cnadv1alpha1.ModeStateful:
+		return "StatefulSet"
+	case cnadv1alpha1.ModeJob:
+		return "ScaledJob"
+	}
+
+	return "Deployment"
+}
+
+// deploymentModeEnabled reports if the agents run in a Deployment
+func deploymentModeEnabled(t *cnadv1alpha1.CDTarget) bool {
+	return agentMode(t) == cnadv1alpha1.ModeDeployment
+}
+
+// ownedKey returns the key of the operands named after the CDTarget
+func ownedKey(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+	return types.NamespacedName{Name: t.Name, Namespace: t.Namespace}
+}
+
+// portsConfigMap returns the ConfigMap with the allowed ports, the default
+// ports are returned when the ConfigMap does not exist yet
+func (r *CDTargetReconciler) portsConfigMap(ctx context.Context) (*corev1.ConfigMap, error) {
+	cfg := r.operatorConfig()
+	cmport := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: cfg.Ports.ConfigMapName,
+		Namespace: r.OperatorNamespace}, cmport)
+	if err == nil || !errors.IsNotFound(err) {
+		return cmport, err
+	}
+
+	cmport, err = r.assets(cfg).ConfigMap(ctx, assets.PortsManifest)
+	if err != nil {
+		return nil, &OperandError{Reason: cnadv1alpha1.ReasonAssetNotAvailable,
+			Message: fmt.Sprintf("unable to load asset %s", assets.PortsManifest), Err: err}
+	}
+	cmport.Name = cfg.Ports.ConfigMapName
+	cmport.Namespace = r.OperatorNamespace
+	if len(cfg.Ports.Defaults) > 0 {
+		cmport.Data = portsConfigMapData(cfg.Ports.Defaults)
+	}
+
+	return cmport, nil
+}
+
+// updateNetworkPolicy applies the desired labels and spec to the live
+// NetworkPolicy, the policy types defaulted by the API server are kept
+func updateNetworkPolicy(live, desired client.Object) bool {
+	l, d := live.(*netv1.NetworkPolicy), desired.(*netv1.NetworkPolicy)
+	spec := d.Spec.DeepCopy()
+	if len(spec.PolicyTypes) == 0 {
+		spec.PolicyTypes = l.Spec.PolicyTypes
+	}
+
+	if equality.Semantic.DeepEqual(l.Labels, d.Labels) &&
+		equality.Semantic.DeepEqual(l.Spec, *spec) {
+		return false
+	}
+
+	l.Labels = d.Labels
+	l.Spec = *spec
+	return true
+}
+
+// defaultOperands returns the built-in operands in reconcile order
+func (r *CDTargetReconciler) defaultOperands() []Operand {
+	return []Operand{
+		// the token Secret is only created so the PAT can be added later,
+		// the controller is not an owner after initial creation
+		&objectOperand{
+			r:    r,
+			name: "TokenSecret",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonSecretNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandSecretFailed,
+				Created:      cnadv1alpha1.ReasonOperandSecretCreated,
+			},
+			enabled: func(t *cnadv1alpha1.CDTarget) bool {
+				return authType(t) == cnadv1alpha1.AuthPAT && len(t.Spec.TokenRef) > 0
+			},
+			newObject: func() client.Object { return &corev1.Secret{} },
+			key: func(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+				return types.NamespacedName{Name: t.Spec.TokenRef, Namespace: t.Namespace}
+			},
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return r.tokenSecretForCDTarget(t), nil
+			},
+			created: func(t *cnadv1alpha1.CDTarget, obj client.Object) string {
+				return fmt.Sprintf("Token Secret %s created, add the AZP_TOKEN value to enable Azure Pipelines auth",
+					obj.GetName())
+			},
+		},
+		// the TriggerAuthentication is only updated when the auth type
+		// changes, the controller is not an owner after initial creation
+		&objectOperand{
+			r:    r,
+			name: "TriggerAuthentication",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonTriggerAuthenticationNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandTriggerAuthenticationFailed,
+				Created:      cnadv1alpha1.ReasonOperandTriggerAuthenticationCreated,
+				Updated:      cnadv1alpha1.ReasonOperandTriggerAuthenticationUpdated,
+			},
+			newObject: func() client.Object { return &kedav2.TriggerAuthentication{} },
+			key: func(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+				return types.NamespacedName{Name: fmt.Sprintf("%s-trigger-auth", t.Spec.Config.PoolName),
+					Namespace: t.Namespace}
+			},
+			// an invalid auth section stops the agent operands
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				if err := validateAuth(t); err != nil {
+					return nil, &OperandError{Reason: cnadv1alpha1.ReasonInvalidAuth,
+						Message: "invalid auth configuration", Err: err}
+				}
+				return r.triggerAuthenticationForCDTarget(t), nil
+			},
+			update: updateTriggerAuthentication,
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				return fmt.Sprintf("TriggerAuthentication %s switched to %s auth", desired.GetName(), authType(t))
+			},
+		},
+		// the agent ServiceAccount carries the workload identity annotations
+		&objectOperand{
+			r:    r,
+			name: "ServiceAccount",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonServiceAccountNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandServiceAccountFailed,
+				Created:      cnadv1alpha1.ReasonOperandServiceAccountCreated,
+				Updated:      cnadv1alpha1.ReasonOperandServiceAccountUpdated,
+			},
+			enabled:   serviceAccountEnabled,
+			newObject: func() client.Object { return &corev1.ServiceAccount{} },
+			key: func(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+				return types.NamespacedName{Name: agentServiceAccountName(t), Namespace: t.Namespace}
+			},
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return r.serviceAccountForCDTarget(t), nil
+			},
+			update:  updateServiceAccount,
+			owned:   true,
+			planned: true,
+		},
+		// the ports ConfigMap in the operator namespace is created from the
+		// defaults and maintained by the cluster admin
+		&objectOperand{
+			r:    r,
+			name: "PortsConfigMap",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonConfigMapNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandConfigMapFailed,
+				Created:      cnadv1alpha1.ReasonOperandConfigMapCreated,
+			},
+			newObject: func() client.Object { return &corev1.ConfigMap{} },
+			key: func(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+				return types.NamespacedName{Name: r.operatorConfig().Ports.ConfigMapName,
+					Namespace: r.OperatorNamespace}
+			},
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return r.portsConfigMap(ctx)
+			},
+			created: func(t *cnadv1alpha1.CDTarget, obj client.Object) string {
+				return fmt.Sprintf("ConfigMap %s created from the default ports", obj.GetName())
+			},
+		},
+		&objectOperand{
+			r:    r,
+			name: "NetworkPolicy",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonNetworkPolicyNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandNetworkPolicyFailed,
+				Created:      cnadv1alpha1.ReasonOperandNetworkPolicyCreated,
+				Updated:      cnadv1alpha1.ReasonOperandNetworkPolicyUpdated,
+			},
+			newObject: func() client.Object { return &netv1.NetworkPolicy{} },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				cmport, err := r.portsConfigMap(ctx)
+				if err != nil {
+					return nil, err
+				}
+				// invalid ports are skipped and reported by validate
+				ports, _ := getPortsFromConfigMap(cmport)
+				return r.networkPolicyForCDTarget(t, ports), nil
+			},
+			validate: func(ctx context.Context, t *cnadv1alpha1.CDTarget) {
+				if cmport, err := r.portsConfigMap(ctx); err == nil {
+					if _, err = getPortsFromConfigMap(cmport); err != nil {
+						log.FromContext(ctx).Error(err, "Failed to parse ports")
+						r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonInvalidPortSkipped,
+							"ConfigMap %s: %s", cmport.Name, err.Error())
+					}
+				}
+				if invalid := invalidIPsForCDTarget(t.Spec.IP); len(invalid) > 0 {
+					r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonInvalidIPSkipped,
+						"invalid IPs skipped: %s", strings.Join(invalid, ", "))
+				}
+				denied := deniedIPsForCDTarget(t.Spec.IP, r.operatorConfig().DeniedIPRanges)
+				if len(denied) > 0 {
+					r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonDeniedIPSkipped,
+						"IPs in a denied range skipped: %s", strings.Join(denied, ", "))
+				}
+			},
+			update: updateNetworkPolicy,
+			created: func(t *cnadv1alpha1.CDTarget, obj client.Object) string {
+				return fmt.Sprintf("NetworkPolicy %s created with %d IPs", obj.GetName(),
+					len(peersForCDTarget(t.Spec.IP)))
+			},
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				added := newPeersForNetworkPolicy(live.(*netv1.NetworkPolicy), desired.(*netv1.NetworkPolicy))
+				if added == 0 {
+					return fmt.Sprintf("NetworkPolicy %s updated", desired.GetName())
+				}
+				return fmt.Sprintf("NetworkPolicy %s updated with %d new IPs", desired.GetName(), added)
+			},
+			owned:   true,
+			planned: true,
+		},
+		&objectOperand{
+			r:    r,
+			name: "PoolNetworkPolicy",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonNetworkPolicyNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandNetworkPolicyFailed,
+				Created:      cnadv1alpha1.ReasonOperandNetworkPolicyCreated,
+				Updated:      cnadv1alpha1.ReasonOperandNetworkPolicyUpdated,
+			},
+			newObject: func() client.Object { return &netv1.NetworkPolicy{} },
+			key: func(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+				return types.NamespacedName{Name: fmt.Sprintf("%s-pool", t.Name), Namespace: t.Namespace}
+			},
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				cfg := r.operatorConfig()
+				azp, err := r.assets(cfg).NetworkPolicy(ctx, assets.PoolNetworkPolicyManifest)
+				if err != nil {
+					return nil, &OperandError{Reason: cnadv1alpha1.ReasonAssetNotAvailable,
+						Message: fmt.Sprintf("unable to load asset %s", assets.PoolNetworkPolicyManifest), Err: err}
+				}
+				azp.ObjectMeta.Name = fmt.Sprintf("%s-pool", t.Name)
+				azp.ObjectMeta.Namespace = t.Namespace
+				azp.ObjectMeta.Labels = t.Spec.AdditionalSelector
+				azp.Spec.PodSelector.MatchLabels = t.Spec.AdditionalSelector
+				setPoolPolicyIPRanges(azp, cfg.AzureDevOpsIPRanges)
+				return azp, nil
+			},
+			update: updateNetworkPolicy,
+			owned:  true,
+		},
+		&objectOperand{
+			r:    r,
+			name: "AgentConfigMap",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonConfigMapNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandConfigMapFailed,
+				Created:      cnadv1alpha1.ReasonOperandConfigMapCreated,
+				Updated:      cnadv1alpha1.ReasonOperandConfigMapUpdated,
+			},
+			newObject: func() client.Object { return &corev1.ConfigMap{} },
+			key: func(t *cnadv1alpha1.CDTarget) types.NamespacedName {
+				return types.NamespacedName{Name: fmt.Sprintf("%s-config", t.Name), Namespace: t.Namespace}
+			},
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return r.configMapForCDTarget(t), nil
+			},
+			update: func(live, desired client.Object) bool {
+				l, d := live.(*corev1.ConfigMap), desired.(*corev1.ConfigMap)
+				if equality.Semantic.DeepEqual(l.Labels, d.Labels) &&
+					equality.Semantic.DeepEqual(l.Data, d.Data) {
+					return false
+				}
+				l.Labels = d.Labels
+				l.Data = d.Data
+				return true
+			},
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				if reflect.DeepEqual(live.(*corev1.ConfigMap).Data, desired.(*corev1.ConfigMap).Data) {
+					return ""
+				}
+				return fmt.Sprintf("ConfigMap %s updated", desired.GetName())
+			},
+			owned: true,
+		},
+		// After creation the Deployment is never updated by the operator
+		// to avoid conflicts with the horizontal pod scaler & KEDA
+		// Only the content hash annotation and the spec.podTemplate fields of
+		// the pod template are patched, the content hash rolls out the agents
+		// when a referenced Secret or ConfigMap changes
+		&objectOperand{
+			r:    r,
+			name: "Deployment",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonDeploymentNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandDeploymentFailed,
+				Created:      cnadv1alpha1.ReasonOperandDeploymentCreated,
+				Updated:      cnadv1alpha1.ReasonOperandDeploymentUpdated,
+			},
+			enabled:   deploymentModeEnabled,
+			newObject: func() client.Object { return &appsv1.Deployment{} },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				if err := holdRollout(t); err != nil {
+					return nil, err
+				}
+				hash, err := r.contentHashForCDTarget(ctx, t, r.configMapForCDTarget(t))
+				if err != nil {
+					return nil, &OperandError{Reason: cnadv1alpha1.ReasonSecretNotAvailable,
+						Message: "unable to compute content hash", Err: err}
+				}
+				deployment := r.deploymentForCDTarget(t)
+				if deployment.Spec.Template.Annotations == nil {
+					deployment.Spec.Template.Annotations = map[string]string{}
+				}
+				deployment.Spec.Template.Annotations[ContentHashAnnotation] = hash
+				return deployment, nil
+			},
+			validate: r.validatePodTemplate,
+			update: func(live, desired client.Object) bool {
+				l, d := live.(*appsv1.Deployment), desired.(*appsv1.Deployment)
+				changed := syncPodTemplateContainers(&l.Spec.Template, &d.Spec.Template)
+				changed = syncPodTemplateOverlay(&l.Spec.Template, &d.Spec.Template) || changed
+				hash := d.Spec.Template.Annotations[ContentHashAnnotation]
+				if l.Spec.Template.Annotations[ContentHashAnnotation] == hash {
+					return changed
+				}
+				if l.Spec.Template.Annotations == nil {
+					l.Spec.Template.Annotations = map[string]string{}
+				}
+				l.Spec.Template.Annotations[ContentHashAnnotation] = hash
+				return true
+			},
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				return fmt.Sprintf("Deployment %s rolled out for %s", desired.GetName(),
+					rolloutReason(&live.(*appsv1.Deployment).Spec.Template, &desired.(*appsv1.Deployment).Spec.Template))
+			},
+			ready: func(live client.Object) bool {
+				d := live.(*appsv1.Deployment)
+				return d.Status.ObservedGeneration >= d.Generation &&
+					d.Status.UpdatedReplicas == d.Status.Replicas &&
+					d.Status.AvailableReplicas == d.Status.Replicas
+			},
+			// scale the agents down so the agent cleanup trap can run
+			cleanup: func(ctx context.Context, t *cnadv1alpha1.CDTarget, live client.Object) (bool, error) {
+				logger := log.FromContext(ctx)
+				deployment := live.(*appsv1.Deployment)
+				if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0 {
+					logger.Info(fmt.Sprintf("Scaling Deployment %s to zero", deployment.Name))
+					patch := client.MergeFrom(deployment.DeepCopy())
+					zero := int32(0)
+					deployment.Spec.Replicas = &zero
+					if err := r.Patch(ctx, deployment, patch); err != nil {
+						return false, err
+					}
+				}
+				if deployment.Status.Replicas > 0 {
+					logger.Info(fmt.Sprintf("Waiting for %d agent pods to terminate", deployment.Status.Replicas))
+					return false, nil
+				}
+				return true, nil
+			},
+			owned:   true,
+			planned: true,
+		},
+		// the headless Service governs the network identity of the
+		// StatefulSet pods, it is only created
+		&objectOperand{
+			r:    r,
+			name: "Service",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonServiceNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandServiceFailed,
+				Created:      cnadv1alpha1.ReasonOperandServiceCreated,
+			},
+			enabled: func(t *cnadv1alpha1.CDTarget) bool {
+				return agentMode(t) == cnadv1alpha1.ModeStateful
+			},
+			newObject: func() client.Object { return &corev1.Service{} },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return headlessServiceForCDTarget(t), nil
+			},
+			owned:   true,
+			planned: true,
+		},
+		// In stateful mode the agents keep their work directory on a
+		// persistent volume, the StatefulSet is patched like the Deployment
+		&objectOperand{
+			r:    r,
+			name: "StatefulSet",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonStatefulSetNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandStatefulSetFailed,
+				Created:      cnadv1alpha1.ReasonOperandStatefulSetCreated,
+				Updated:      cnadv1alpha1.ReasonOperandStatefulSetUpdated,
+			},
+			enabled: func(t *cnadv1alpha1.CDTarget) bool {
+				return agentMode(t) == cnadv1alpha1.ModeStateful
+			},
+			newObject: func() client.Object { return &appsv1.StatefulSet{} },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				if err := holdRollout(t); err != nil {
+					return nil, err
+				}
+				hash, err := r.contentHashForCDTarget(ctx, t, r.configMapForCDTarget(t))
+				if err != nil {
+					return nil, &OperandError{Reason: cnadv1alpha1.ReasonSecretNotAvailable,
+						Message: "unable to compute content hash", Err: err}
+				}
+				sts := r.statefulSetForCDTarget(t)
+				if sts.Spec.Template.Annotations == nil {
+					sts.Spec.Template.Annotations = map[string]string{}
+				}
+				sts.Spec.Template.Annotations[ContentHashAnnotation] = hash
+				return sts, nil
+			},
+			validate: func(ctx context.Context, t *cnadv1alpha1.CDTarget) {
+				r.validatePodTemplate(ctx, t)
+				r.validateStatefulStorage(ctx, t)
+			},
+			update: func(live, desired client.Object) bool {
+				l, d := live.(*appsv1.StatefulSet), desired.(*appsv1.StatefulSet)
+				changed := syncPodTemplateContainers(&l.Spec.Template, &d.Spec.Template)
+				changed = syncPodTemplateOverlay(&l.Spec.Template, &d.Spec.Template) || changed
+				hash := d.Spec.Template.Annotations[ContentHashAnnotation]
+				if l.Spec.Template.Annotations[ContentHashAnnotation] == hash {
+					return changed
+				}
+				if l.Spec.Template.Annotations == nil {
+					l.Spec.Template.Annotations = map[string]string{}
+				}
+				l.Spec.Template.Annotations[ContentHashAnnotation] = hash
+				return true
+			},
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				return fmt.Sprintf("StatefulSet %s rolled out for %s", desired.GetName(),
+					rolloutReason(&live.(*appsv1.StatefulSet).Spec.Template, &desired.(*appsv1.StatefulSet).Spec.Template))
+			},
+			ready: func(live client.Object) bool {
+				s := live.(*appsv1.StatefulSet)
+				return s.Status.ObservedGeneration >= s.Generation &&
+					s.Status.UpdatedReplicas == s.Status.Replicas &&
+					s.Status.ReadyReplicas == s.Status.Replicas
+			},
+			// scale the agents down so the agent cleanup trap can run
+			cleanup: func(ctx context.Context, t *cnadv1alpha1.CDTarget, live client.Object) (bool, error) {
+				logger := log.FromContext(ctx)
+				sts := live.(*appsv1.StatefulSet)
+				if sts.Spec.Replicas == nil || *sts.Spec.Replicas != 0 {
+					logger.Info(fmt.Sprintf("Scaling StatefulSet %s to zero", sts.Name))
+					patch := client.MergeFrom(sts.DeepCopy())
+					zero := int32(0)
+					sts.Spec.Replicas = &zero
+					if err := r.Patch(ctx, sts, patch); err != nil {
+						return false, err
+					}
+				}
+				if sts.Status.Replicas > 0 {
+					logger.Info(fmt.Sprintf("Waiting for %d agent pods to terminate", sts.Status.Replicas))
+					return false, nil
+				}
+				return true, nil
+			},
+			owned:   true,
+			planned: true,
+		},
+		// After creation only the scale target of the ScaledObject is
+		// updated by the operator, when the agent mode changes
+		&objectOperand{
+			r:    r,
+			name: "ScaledObject",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonScaledObjectNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandScaledObjectFailed,
+				Created:      cnadv1alpha1.ReasonOperandScaledObjectCreated,
+				Updated:      cnadv1alpha1.ReasonOperandScaledObjectUpdated,
+			},
+			enabled: func(t *cnadv1alpha1.CDTarget) bool {
+				return agentMode(t) != cnadv1alpha1.ModeJob
+			},
+			newObject: func() client.Object { return &kedav2.ScaledObject{} },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return r.scaledObjectForCDTarget(t), nil
+			},
+			update: func(live, desired client.Object) bool {
+				l, d := live.(*kedav2.ScaledObject), desired.(*kedav2.ScaledObject)
+				if reflect.DeepEqual(l.Spec.ScaleTargetRef, d.Spec.ScaleTargetRef) {
+					return false
+				}
+				l.Spec.ScaleTargetRef = d.Spec.ScaleTargetRef
+				return true
+			},
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				return fmt.Sprintf("ScaledObject %s now scales %s %s", desired.GetName(),
+					agentWorkloadKind(t), desired.GetName())
+			},
+			ready: func(live client.Object) bool {
+				so := live.(*kedav2.ScaledObject)
+				ready := so.Status.Conditions.GetReadyCondition()
+				return ready.IsTrue()
+			},
+			// remove the ScaledObject first so KEDA does not scale the agents back up
+			cleanup: func(ctx context.Context, t *cnadv1alpha1.CDTarget, live client.Object) (bool, error) {
+				log.FromContext(ctx).Info(fmt.Sprintf("Deleting ScaledObject %s", live.GetName()))
+				if err := r.Delete(ctx, live); err != nil && !errors.IsNotFound(err) {
+					return false, err
+				}
+				return true, nil
+			},
+			owned:   true,
+			planned: true,
+		},
+		// In job mode KEDA creates a Job per queued pipeline job, only the
+		// content hash annotation and the spec.podTemplate fields of the job
+		// template are patched
+		&objectOperand{
+			r:    r,
+			name: "ScaledJob",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonScaledJobNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandScaledJobFailed,
+				Created:      cnadv1alpha1.ReasonOperandScaledJobCreated,
+				Updated:      cnadv1alpha1.ReasonOperandScaledJobUpdated,
+			},
+			enabled: func(t *cnadv1alpha1.CDTarget) bool {
+				return agentMode(t) == cnadv1alpha1.ModeJob
+			},
+			newObject: func() client.Object { return &kedav2.ScaledJob{} },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				if err := validateJobExtensions(t); err != nil {
+					return nil, err
+				}
+				if err := holdRollout(t); err != nil {
+					return nil, err
+				}
+				hash, err := r.contentHashForCDTarget(ctx, t, r.configMapForCDTarget(t))
+				if err != nil {
+					return nil, &OperandError{Reason: cnadv1alpha1.ReasonSecretNotAvailable,
+						Message: "unable to compute content hash", Err: err}
+				}
+				sj := r.scaledJobForCDTarget(t)
+				template := &sj.Spec.JobTargetRef.Template
+				if template.Annotations == nil {
+					template.Annotations = map[string]string{}
+				}
+				template.Annotations[ContentHashAnnotation] = hash
+				return sj, nil
+			},
+			validate: r.validatePodTemplate,
+			update: func(live, desired client.Object) bool {
+				l, d := live.(*kedav2.ScaledJob), desired.(*kedav2.ScaledJob)
+				if l.Spec.JobTargetRef == nil {
+					return false
+				}
+				template := &l.Spec.JobTargetRef.Template
+				changed := syncPodTemplateContainers(template, &d.Spec.JobTargetRef.Template)
+				changed = syncPodTemplateOverlay(template, &d.Spec.JobTargetRef.Template) || changed
+				hash := d.Spec.JobTargetRef.Template.Annotations[ContentHashAnnotation]
+				if template.Annotations[ContentHashAnnotation] == hash {
+					return changed
+				}
+				if template.Annotations == nil {
+					template.Annotations = map[string]string{}
+				}
+				template.Annotations[ContentHashAnnotation] = hash
+				return true
+			},
+			updated: func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string {
+				l, d := live.(*kedav2.ScaledJob), desired.(*kedav2.ScaledJob)
+				if l.Spec.JobTargetRef == nil {
+					return ""
+				}
+				return fmt.Sprintf("ScaledJob %s job template updated for %s", desired.GetName(),
+					rolloutReason(&l.Spec.JobTargetRef.Template, &d.Spec.JobTargetRef.Template))
+			},
+			ready: func(live client.Object) bool {
+				sj := live.(*kedav2.ScaledJob)
+				ready := sj.Status.Conditions.GetReadyCondition()
+				return ready.IsTrue()
+			},
+			cleanup: func(ctx context.Context, t *cnadv1alpha1.CDTarget, live client.Object) (bool, error) {
+				log.FromContext(ctx).Info(fmt.Sprintf("Deleting ScaledJob %s", live.GetName()))
+				if err := r.Delete(ctx, live, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil &&
+					!errors.IsNotFound(err) {
+					return false, err
+				}
+				return true, nil
+			},
+			owned:   true,
+			planned: true,
+		},
+		// The monitoring operands are only rendered with spec.monitoring
+		&objectOperand{
+			r:    r,
+			name: "PrometheusRule",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonMonitoringNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandMonitoringFailed,
+				Created:      cnadv1alpha1.ReasonOperandMonitoringCreated,
+				Updated:      cnadv1alpha1.ReasonOperandMonitoringUpdated,
+			},
+			enabled:   prometheusRuleEnabled,
+			newObject: func() client.Object { return newMonitoringObject(prometheusRuleGVK) },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return prometheusRuleForCDTarget(t), nil
+			},
+			update:  updateMonitoringObject,
+			owned:   true,
+			planned: true,
+		},
+		&objectOperand{
+			r:    r,
+			name: "PodMonitor",
+			reasons: operandReasons{
+				NotAvailable: cnadv1alpha1.ReasonMonitoringNotAvailable,
+				Failed:       cnadv1alpha1.ReasonOperandMonitoringFailed,
+				Created:      cnadv1alpha1.ReasonOperandMonitoringCreated,
+				Updated:      cnadv1alpha1.ReasonOperandMonitoringUpdated,
+			},
+			enabled:   podMonitorEnabled,
+			newObject: func() client.Object { return newMonitoringObject(podMonitorGVK) },
+			key:       ownedKey,
+			render: func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+				return podMonitorForCDTarget(t), nil
+			},
+			update:  updateMonitoringObject,
+			owned:   true,
+			planned: true,
+		},
+	}
+}
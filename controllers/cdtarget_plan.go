@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// PlanAnnotation switches a CDTarget to plan mode when set to "true", the
+	// operator reports the operand changes in status.plan without applying them
+	PlanAnnotation = "cnad.gofound.nl/plan"
+
+	PlanActionCreate    = "Create"
+	PlanActionUpdate    = "Update"
+	PlanActionUnchanged = "Unchanged"
+	PlanActionDrift     = "Drift"
+	PlanActionDelete    = "Delete"
+)
+
+// isPlanMode reports if the CDTarget only requests a plan of the operand changes
+func isPlanMode(t *cnadv1alpha1.CDTarget) bool {
+	return t.Annotations[PlanAnnotation] == "true"
+}
+
+// planner is implemented by operands that can report their planned changes
+type planner interface {
+	Plan(ctx context.Context, t *cnadv1alpha1.CDTarget) (cnadv1alpha1.OperandPlan, bool, error)
+}
+
+// planCDTarget renders the operands with the reconcile builders and stores the
+// differences with the live operands in the status, no operand is modified
+func (r *CDTargetReconciler) planCDTarget(ctx context.Context, t *cnadv1alpha1.CDTarget) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var plan []cnadv1alpha1.OperandPlan
+	var summary []string
+	for _, o := range r.operands() {
+		pl, ok := o.(planner)
+		if !ok {
+			continue
+		}
+		p, planned, err := pl.Plan(ctx, t)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to plan operand %s", o.Name()))
+			return ctrl.Result{}, err
+		}
+		if !planned {
+			continue
+		}
+		plan = append(plan, p)
+		summary = append(summary, fmt.Sprintf("%s %s: %s", p.Kind, p.Name, p.Action))
+	}
+
+	if !reflect.DeepEqual(t.Status.Plan, plan) || t.Status.PlanGeneration != t.Generation {
+		r.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonPlanComputed,
+			"plan computed, no changes applied: %s", strings.Join(summary, ", "))
+	}
+
+	t.Status.Plan = plan
+	t.Status.PlanGeneration = t.Generation
+	return ctrl.Result{}, r.updateStatus(ctx, t)
+}
+
+// Plan compares the desired object with the live object, the action is
+// Update when the operand update applies all changes and Drift otherwise
+func (o *objectOperand) Plan(ctx context.Context, t *cnadv1alpha1.CDTarget) (cnadv1alpha1.OperandPlan, bool, error) {
+	if !o.planned {
+		return cnadv1alpha1.OperandPlan{}, false, nil
+	}
+
+	if !o.Enabled(t) {
+		live, err := o.live(ctx, t)
+		if err != nil || live == nil || !metav1.IsControlledBy(live, t) {
+			return cnadv1alpha1.OperandPlan{}, false, client.IgnoreNotFound(err)
+		}
+		return cnadv1alpha1.OperandPlan{Kind: o.kind(live), Name: live.GetName(),
+			Action: PlanActionDelete}, true, nil
+	}
+
+	desired, err := o.Render(ctx, t)
+	if err != nil {
+		return cnadv1alpha1.OperandPlan{}, false, err
+	}
+	p := cnadv1alpha1.OperandPlan{Kind: o.kind(desired), Name: desired.GetName()}
+
+	live := o.newObject()
+	err = o.r.Get(ctx, client.ObjectKeyFromObject(desired), live)
+	if err != nil && errors.IsNotFound(err) {
+		p.Action = PlanActionCreate
+		return p, true, nil
+	} else if err != nil {
+		return p, false, err
+	}
+
+	if p.Changes, err = diffOperand(live, desired); err != nil {
+		return p, false, err
+	}
+
+	if len(p.Changes) == 0 {
+		p.Action = PlanActionUnchanged
+		return p, true, nil
+	}
+
+	p.Action = PlanActionDrift
+	if o.update != nil {
+		updated := live.DeepCopyObject().(client.Object)
+		o.update(updated, desired)
+		remaining, err := diffOperand(updated, desired)
+		if err != nil {
+			return p, false, err
+		}
+		if len(remaining) == 0 {
+			p.Action = PlanActionUpdate
+		}
+	}
+
+	return p, true, nil
+}
+
+// diffOperand returns the labels and spec fields that differ between the
+// desired and the live operand, fields removed from the desired operand are
+// reported with a null desired value, fields defaulted by the API server
+// and absent from the desired operand are ignored
+func diffOperand(live, desired client.Object) ([]cnadv1alpha1.FieldChange, error) {
+	l, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, err
+	}
+	d, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	// the operator owns all labels of its operands, a dropped label is a removal
+	labels := fieldOf(d, "metadata", "labels")
+	if labels == nil {
+		labels = map[string]interface{}{}
+	}
+
+	var changes []cnadv1alpha1.FieldChange
+	diffFields("metadata.labels", fieldOf(l, "metadata", "labels"), labels, &changes)
+	diffFields("spec", l["spec"], d["spec"], &changes)
+
+	return changes, nil
+}
+
+func fieldOf(obj map[string]interface{}, path ...string) interface{} {
+	var v interface{} = obj
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+
+	return v
+}
+
+// serverDefaultedFields are the fields of the operands the API server sets
+// when they are not in the desired object, they are not reported as removed
+var serverDefaultedFields = map[string]bool{
+	// pods and containers
+	"restartPolicy": true, "dnsPolicy": true, "schedulerName": true, "terminationGracePeriodSeconds": true,
+	"serviceAccount": true, "priority": true, "preemptionPolicy": true, "enableServiceLinks": true,
+	"terminationMessagePath": true, "terminationMessagePolicy": true, "imagePullPolicy": true,
+	"protocol": true, "apiVersion": true, "defaultMode": true,
+	"timeoutSeconds": true, "periodSeconds": true, "successThreshold": true, "failureThreshold": true,
+	// Deployments and StatefulSets
+	"strategy": true, "revisionHistoryLimit": true, "progressDeadlineSeconds": true,
+	"podManagementPolicy": true, "updateStrategy": true, "persistentVolumeClaimRetentionPolicy": true,
+	"volumeMode": true, "status": true,
+	// Services and NetworkPolicies
+	"clusterIP": true, "clusterIPs": true, "ipFamilies": true, "ipFamilyPolicy": true,
+	"sessionAffinity": true, "internalTrafficPolicy": true, "targetPort": true, "policyTypes": true,
+}
+
+// emptyValue reports if a live value carries no setting
+func emptyValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+
+	return false
+}
+
+func diffFields(path string, live, desired interface{}, changes *[]cnadv1alpha1.FieldChange) {
+	switch d := desired.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		if len(d) == 0 && emptyValue(live) {
+			return
+		}
+		if l, ok := live.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(d)+len(l))
+			for k := range d {
+				// an empty struct of a defaulted field is filled by the API server
+				if !serverDefaultedFields[k] || !emptyValue(d[k]) {
+					keys = append(keys, k)
+				}
+			}
+			for k := range l {
+				if _, ok := d[k]; !ok && !serverDefaultedFields[k] && !emptyValue(l[k]) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if _, ok := d[k]; !ok {
+					*changes = append(*changes, cnadv1alpha1.FieldChange{
+						Path:    fmt.Sprintf("%s.%s", path, k),
+						Live:    jsonValue(l[k]),
+						Desired: "null",
+					})
+					continue
+				}
+				diffFields(fmt.Sprintf("%s.%s", path, k), l[k], d[k], changes)
+			}
+			return
+		}
+	case []interface{}:
+		if len(d) == 0 && emptyValue(live) {
+			return
+		}
+		if l, ok := live.([]interface{}); ok && len(l) == len(d) {
+			for i := range d {
+				diffFields(fmt.Sprintf("%s[%d]", path, i), l[i], d[i], changes)
+			}
+			return
+		}
+	default:
+		if reflect.DeepEqual(live, desired) {
+			return
+		}
+	}
+
+	*changes = append(*changes, cnadv1alpha1.FieldChange{
+		Path:    path,
+		Live:    jsonValue(live),
+		Desired: jsonValue(desired),
+	})
+}
+
+func jsonValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(b)
+}
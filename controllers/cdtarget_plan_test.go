@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func TestDiffOperand(t *testing.T) {
+	desired := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Labels: map[string]string{"team": "a"}},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "agent", Image: "agent:1"}},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(live *appsv1.Deployment)
+		want   []cnadv1alpha1.FieldChange
+	}{
+		{
+			name: "server defaulted",
+			mutate: func(live *appsv1.Deployment) {
+				live.Spec.RevisionHistoryLimit = pointer.Int32(10)
+				live.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RollingUpdateDeploymentStrategyType}
+				live.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+				live.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{}
+				live.Spec.Template.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+			},
+		},
+		{
+			name:   "changed image",
+			mutate: func(live *appsv1.Deployment) { live.Spec.Template.Spec.Containers[0].Image = "agent:0" },
+			want: []cnadv1alpha1.FieldChange{{Path: "spec.template.spec.containers[0].image",
+				Live: `"agent:0"`, Desired: `"agent:1"`}},
+		},
+		{
+			name:   "removed label",
+			mutate: func(live *appsv1.Deployment) { live.Labels["cost-center"] = "42" },
+			want: []cnadv1alpha1.FieldChange{{Path: "metadata.labels.cost-center",
+				Live: `"42"`, Desired: "null"}},
+		},
+		{
+			name: "removed env source and limits",
+			mutate: func(live *appsv1.Deployment) {
+				c := &live.Spec.Template.Spec.Containers[0]
+				c.EnvFrom = []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "extra"}}}}
+				c.Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+			},
+			want: []cnadv1alpha1.FieldChange{
+				{Path: "spec.template.spec.containers[0].envFrom",
+					Live: `[{"secretRef":{"name":"extra"}}]`, Desired: "null"},
+				{Path: "spec.template.spec.containers[0].resources.limits",
+					Live: `{"cpu":"1"}`, Desired: "null"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := desired.DeepCopy()
+			tt.mutate(live)
+
+			got, err := diffOperand(live, desired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffOperand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffOperandRemovedPodSelector(t *testing.T) {
+	desired := &netv1.NetworkPolicy{Spec: netv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+	}}
+	live := desired.DeepCopy()
+	live.Spec.PodSelector.MatchLabels["team"] = "a"
+	live.Spec.PolicyTypes = []netv1.PolicyType{netv1.PolicyTypeEgress}
+
+	got, err := diffOperand(live, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cnadv1alpha1.FieldChange{{Path: "spec.podSelector.matchLabels.team", Live: `"a"`, Desired: "null"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffOperand() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// podTemplateField is a field of spec.podTemplate, set reports if the overlay
+// sets the field and apply copies it onto the pod template
+type podTemplateField struct {
+	name  string
+	set   func(o *cnadv1alpha1.PodTemplateOverlay) bool
+	apply func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec)
+}
+
+var podTemplateFields = []podTemplateField{
+	{"nodeSelector",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return len(o.NodeSelector) > 0 },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) { spec.NodeSelector = o.NodeSelector }},
+	{"tolerations",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return len(o.Tolerations) > 0 },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) { spec.Tolerations = o.Tolerations }},
+	{"affinity",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return o.Affinity != nil },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) { spec.Affinity = o.Affinity }},
+	{"topologySpreadConstraints",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return len(o.TopologySpreadConstraints) > 0 },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) {
+			spec.TopologySpreadConstraints = o.TopologySpreadConstraints
+		}},
+	{"priorityClassName",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return len(o.PriorityClassName) > 0 },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) {
+			spec.PriorityClassName = o.PriorityClassName
+		}},
+	{"securityContext",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return o.SecurityContext != nil },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) {
+			spec.SecurityContext = o.SecurityContext
+		}},
+	{"containerSecurityContext",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return o.ContainerSecurityContext != nil },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) {
+			for i, container := range spec.Containers {
+				if container.Name == "agent" {
+					spec.Containers[i].SecurityContext = o.ContainerSecurityContext
+				}
+			}
+		}},
+	{"serviceAccountName",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return len(o.ServiceAccountName) > 0 },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) {
+			spec.ServiceAccountName = o.ServiceAccountName
+		}},
+	{"hostAliases",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return len(o.HostAliases) > 0 },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) { spec.HostAliases = o.HostAliases }},
+	{"runtimeClassName",
+		func(o *cnadv1alpha1.PodTemplateOverlay) bool { return o.RuntimeClassName != nil },
+		func(o *cnadv1alpha1.PodTemplateOverlay, spec *corev1.PodSpec) {
+			spec.RuntimeClassName = o.RuntimeClassName
+		}},
+}
+
+// allowedPodTemplateField reports if the operator configuration allows the field
+func (r *CDTargetReconciler) allowedPodTemplateField(name string) bool {
+	for _, f := range r.operatorConfig().PodTemplate.AllowedFields {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deniedPodTemplateFields returns the fields set in spec.podTemplate and
+// the agent extensions that are not allowed by the operator configuration
+func (r *CDTargetReconciler) deniedPodTemplateFields(t *cnadv1alpha1.CDTarget) []string {
+	var denied []string
+
+	for _, f := range podTemplateFields {
+		if t.Spec.PodTemplate != nil && f.set(t.Spec.PodTemplate) && !r.allowedPodTemplateField(f.name) {
+			denied = append(denied, f.name)
+		}
+	}
+	for _, e := range agentExtensions {
+		if e.set(t) && !r.allowedPodTemplateField(e.name) {
+			denied = append(denied, e.name)
+		}
+	}
+
+	return denied
+}
+
+// applyPodTemplateOverlay merges the allowed fields of spec.podTemplate onto
+// the rendered agent pod template, denied fields are skipped
+func (r *CDTargetReconciler) applyPodTemplateOverlay(t *cnadv1alpha1.CDTarget, template *corev1.PodTemplateSpec) {
+	if t.Spec.PodTemplate == nil {
+		return
+	}
+
+	for _, f := range podTemplateFields {
+		if f.set(t.Spec.PodTemplate) && r.allowedPodTemplateField(f.name) {
+			f.apply(t.Spec.PodTemplate, &template.Spec)
+		}
+	}
+}
+
+// validatePodTemplate reports the skipped fields of spec.podTemplate
+func (r *CDTargetReconciler) validatePodTemplate(ctx context.Context, t *cnadv1alpha1.CDTarget) {
+	if denied := r.deniedPodTemplateFields(t); len(denied) > 0 {
+		r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonPodTemplateFieldSkipped,
+			"podTemplate fields and extensions not allowed by the operator configuration skipped: %s", strings.Join(denied, ", "))
+	}
+}
+
+// syncPodTemplateOverlay copies the fields managed by spec.podTemplate from
+// the desired onto the live pod template and reports if they changed, the
+// other fields of the live pod template are left untouched
+func syncPodTemplateOverlay(live, desired *corev1.PodTemplateSpec) bool {
+	l, d := &live.Spec, &desired.Spec
+
+	// the API server defaults an unset pod security context to an empty one
+	securityContext := d.SecurityContext
+	if securityContext == nil {
+		securityContext = &corev1.PodSecurityContext{}
+	}
+
+	var liveContainer, desiredContainer *corev1.SecurityContext
+	agent := -1
+	for i, container := range l.Containers {
+		if container.Name == "agent" {
+			agent, liveContainer = i, container.SecurityContext
+		}
+	}
+	for _, container := range d.Containers {
+		if container.Name == "agent" {
+			desiredContainer = container.SecurityContext
+		}
+	}
+
+	if equality.Semantic.DeepEqual(l.NodeSelector, d.NodeSelector) &&
+		equality.Semantic.DeepEqual(l.Tolerations, d.Tolerations) &&
+		equality.Semantic.DeepEqual(l.Affinity, d.Affinity) &&
+		equality.Semantic.DeepEqual(l.TopologySpreadConstraints, d.TopologySpreadConstraints) &&
+		l.PriorityClassName == d.PriorityClassName &&
+		equality.Semantic.DeepEqual(l.SecurityContext, securityContext) &&
+		equality.Semantic.DeepEqual(liveContainer, desiredContainer) &&
+		l.ServiceAccountName == d.ServiceAccountName &&
+		equality.Semantic.DeepEqual(l.HostAliases, d.HostAliases) &&
+		equality.Semantic.DeepEqual(l.RuntimeClassName, d.RuntimeClassName) {
+		return false
+	}
+
+	l.NodeSelector = d.NodeSelector
+	l.Tolerations = d.Tolerations
+	l.Affinity = d.Affinity
+	l.TopologySpreadConstraints = d.TopologySpreadConstraints
+	l.PriorityClassName = d.PriorityClassName
+	l.SecurityContext = securityContext
+	if agent >= 0 {
+		l.Containers[agent].SecurityContext = desiredContainer
+	}
+	// the deprecated field is copied to serviceAccountName when it is empty
+	l.ServiceAccountName = d.ServiceAccountName
+	l.DeprecatedServiceAccount = d.ServiceAccountName
+	l.HostAliases = d.HostAliases
+	l.RuntimeClassName = d.RuntimeClassName
+
+	return true
+}
+
+// containersDrifted reports if the containers, init containers or volumes of
+// the live pod template differ from the desired ones, fields removed from the
+// desired pod template are a drift, fields defaulted by the API server and
+// not set in the desired pod template are ignored
+func containersDrifted(live, desired *corev1.PodTemplateSpec) bool {
+	l, d := &live.Spec, &desired.Spec
+	if len(l.Containers) != len(d.Containers) ||
+		len(l.InitContainers) != len(d.InitContainers) ||
+		len(l.Volumes) != len(d.Volumes) {
+		return true
+	}
+
+	lu, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.PodSpec{
+		Containers: l.Containers, InitContainers: l.InitContainers, Volumes: l.Volumes})
+	if err != nil {
+		return true
+	}
+	du, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.PodSpec{
+		Containers: d.Containers, InitContainers: d.InitContainers, Volumes: d.Volumes})
+	if err != nil {
+		return true
+	}
+
+	var changes []cnadv1alpha1.FieldChange
+	diffFields("spec", lu, du, &changes)
+	return len(changes) > 0
+}
+
+// syncPodTemplateContainers copies the desired containers, init containers
+// and volumes onto the live pod template when they drifted
+func syncPodTemplateContainers(live, desired *corev1.PodTemplateSpec) bool {
+	if !containersDrifted(live, desired) {
+		return false
+	}
+
+	live.Spec.Containers = desired.Spec.Containers
+	live.Spec.InitContainers = desired.Spec.InitContainers
+	live.Spec.Volumes = desired.Spec.Volumes
+	return true
+}
+
+// rolloutReason describes why the agent pod template is updated
+func rolloutReason(live, desired *corev1.PodTemplateSpec) string {
+	if live.Annotations[ContentHashAnnotation] != desired.Annotations[ContentHashAnnotation] {
+		return "changed Secret or ConfigMap content"
+	}
+	if containersDrifted(live, desired) {
+		return "changed containers or volumes"
+	}
+
+	return "changed spec.podTemplate"
+}
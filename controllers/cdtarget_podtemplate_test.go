@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/pointer"
+)
+
+func reconcilerWithAllowedFields(t *testing.T, fields ...string) *CDTargetReconciler {
+	store, err := operatorconfig.NewStore("", &configv1alpha1.OperatorConfig{
+		PodTemplate: configv1alpha1.PodTemplateConfig{AllowedFields: fields},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &CDTargetReconciler{Config: store}
+}
+
+func podTemplateTarget() *cnadv1alpha1.CDTarget {
+	target := &cnadv1alpha1.CDTarget{Spec: cnadv1alpha1.CDTargetSpec{
+		TokenRef: "cdtarget-token",
+		PodTemplate: &cnadv1alpha1.PodTemplateOverlay{
+			NodeSelector:       map[string]string{"agentpool": "build"},
+			ServiceAccountName: "privileged",
+			HostAliases:        []corev1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"registry"}}},
+		},
+		Sidecars: []corev1.Container{{Name: "cache", Image: "cache:1"}},
+		DinD:     true,
+	}}
+	target.Name = "cdtarget"
+
+	return target
+}
+
+func TestDeniedPodTemplateFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		want    []string
+	}{
+		{
+			name:    "fields and extensions denied",
+			allowed: []string{"nodeSelector"},
+			want:    []string{"serviceAccountName", "hostAliases", "sidecars", "dind"},
+		},
+		{
+			name:    "extensions allowed",
+			allowed: []string{"nodeSelector", "sidecars", "dind"},
+			want:    []string{"serviceAccountName", "hostAliases"},
+		},
+		{
+			name:    "all allowed",
+			allowed: []string{"nodeSelector", "serviceAccountName", "hostAliases", "sidecars", "dind"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := reconcilerWithAllowedFields(t, tt.allowed...)
+			if got := r.deniedPodTemplateFields(podTemplateTarget()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deniedPodTemplateFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeniedFieldsSkipped(t *testing.T) {
+	r := reconcilerWithAllowedFields(t, "nodeSelector")
+	spec := r.deploymentForCDTarget(podTemplateTarget()).Spec.Template.Spec
+
+	if !reflect.DeepEqual(spec.NodeSelector, map[string]string{"agentpool": "build"}) {
+		t.Errorf("allowed nodeSelector not applied: %v", spec.NodeSelector)
+	}
+	if len(spec.ServiceAccountName) > 0 {
+		t.Errorf("denied serviceAccountName applied: %s", spec.ServiceAccountName)
+	}
+	if len(spec.HostAliases) > 0 {
+		t.Errorf("denied hostAliases applied: %v", spec.HostAliases)
+	}
+	if len(spec.Containers) != 1 {
+		t.Errorf("denied sidecars or dind added: %d containers", len(spec.Containers))
+	}
+}
+
+// serverDefaulted returns a copy of the pod template with the fields the API
+// server defaults on create
+func serverDefaulted(template *corev1.PodTemplateSpec) *corev1.PodTemplateSpec {
+	live := template.DeepCopy()
+	spec := &live.Spec
+	spec.RestartPolicy = corev1.RestartPolicyAlways
+	spec.DNSPolicy = corev1.DNSClusterFirst
+	spec.SchedulerName = corev1.DefaultSchedulerName
+	spec.TerminationGracePeriodSeconds = pointer.Int64(30)
+	if spec.SecurityContext == nil {
+		spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].TerminationMessagePath = corev1.TerminationMessagePathDefault
+		spec.Containers[i].TerminationMessagePolicy = corev1.TerminationMessageReadFile
+		spec.Containers[i].ImagePullPolicy = corev1.PullIfNotPresent
+	}
+	for i := range spec.Volumes {
+		if spec.Volumes[i].Secret != nil {
+			spec.Volumes[i].Secret.DefaultMode = pointer.Int32(0644)
+		}
+	}
+
+	return live
+}
+
+func TestPodTemplateDrift(t *testing.T) {
+	r := reconcilerWithAllowedFields(t, "nodeSelector")
+	target := podTemplateTarget()
+	target.Spec.CACertRef = "cdtarget-ca"
+	target.Spec.AgentImage = "agent:1"
+	desired := &r.deploymentForCDTarget(target).Spec.Template
+
+	tests := []struct {
+		name       string
+		mutate     func(live *corev1.PodTemplateSpec)
+		overlay    bool
+		containers bool
+	}{
+		{
+			name:   "server defaulted",
+			mutate: func(live *corev1.PodTemplateSpec) {},
+		},
+		{
+			name:    "changed nodeSelector",
+			mutate:  func(live *corev1.PodTemplateSpec) { live.Spec.NodeSelector = map[string]string{"agentpool": "old"} },
+			overlay: true,
+		},
+		{
+			name:    "manual toleration",
+			mutate:  func(live *corev1.PodTemplateSpec) { live.Spec.Tolerations = []corev1.Toleration{{Key: "build"}} },
+			overlay: true,
+		},
+		{
+			name:       "changed image",
+			mutate:     func(live *corev1.PodTemplateSpec) { live.Spec.Containers[0].Image = "agent:old" },
+			containers: true,
+		},
+		{
+			name: "removed envFrom and limits",
+			mutate: func(live *corev1.PodTemplateSpec) {
+				c := &live.Spec.Containers[0]
+				c.EnvFrom = []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "extra"}}}}
+				c.Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+			},
+			containers: true,
+		},
+		{
+			name: "removed securityContext and subPath",
+			mutate: func(live *corev1.PodTemplateSpec) {
+				live.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{RunAsNonRoot: pointer.Bool(true)}
+				live.Spec.Containers[0].VolumeMounts[0].SubPath = "certs"
+			},
+			containers: true,
+			overlay:    true,
+		},
+		{
+			name: "added volume",
+			mutate: func(live *corev1.PodTemplateSpec) {
+				live.Spec.Volumes = append(live.Spec.Volumes, corev1.Volume{Name: "extra"})
+			},
+			containers: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := serverDefaulted(desired)
+			tt.mutate(live)
+
+			if got := containersDrifted(live, desired); got != tt.containers {
+				t.Errorf("containersDrifted() = %v, want %v", got, tt.containers)
+			}
+			if got := syncPodTemplateOverlay(live, desired); got != tt.overlay {
+				t.Errorf("syncPodTemplateOverlay() = %v, want %v", got, tt.overlay)
+			}
+			// a synced live template needs no further update
+			if syncPodTemplateOverlay(live, desired) {
+				t.Error("syncPodTemplateOverlay() reports a change after the sync")
+			}
+			if syncPodTemplateContainers(live, desired); containersDrifted(live, desired) {
+				t.Error("containersDrifted() reports a drift after the sync")
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ package controllers
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 
@@ -28,11 +29,28 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// cidrForIP returns the single address CIDR of ip, /32 for IPv4 and /128
+// for IPv6 addresses, false when ip is not a valid IP address
+func cidrForIP(ip string) (string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%s/32", v4), true
+	}
+
+	return fmt.Sprintf("%s/128", parsed), true
+}
+
 func peersForCDTarget(list []string) []netv1.NetworkPolicyPeer {
 	var peers []netv1.NetworkPolicyPeer
 
 	for _, ip := range list {
-		target := fmt.Sprintf("%s/32", ip)
+		target, ok := cidrForIP(ip)
+		if !ok {
+			continue
+		}
 		peers = append(peers, netv1.NetworkPolicyPeer{
 			IPBlock: &netv1.IPBlock{
 				CIDR: target}})
@@ -41,21 +59,161 @@ func peersForCDTarget(list []string) []netv1.NetworkPolicyPeer {
 	return peers
 }
 
+// invalidIPsForCDTarget returns the entries of list that are not valid IP
+// addresses and are therefore skipped by peersForCDTarget
+func invalidIPsForCDTarget(list []string) []string {
+	var invalid []string
+
+	for _, ip := range list {
+		if _, ok := cidrForIP(ip); !ok {
+			invalid = append(invalid, ip)
+		}
+	}
+
+	return invalid
+}
+
+// deniedIPsForCDTarget returns the valid IPs of list that are part of
+// one of the denied CIDRs of the operator configuration
+func deniedIPsForCDTarget(list []string, deniedRanges []string) []string {
+	var denied []string
+
+	for _, ip := range list {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		for _, cidr := range deniedRanges {
+			_, network, err := net.ParseCIDR(cidr)
+			if err == nil && network.Contains(parsed) {
+				denied = append(denied, ip)
+				break
+			}
+		}
+	}
+
+	return denied
+}
+
+// allowedIPsForCDTarget removes the denied IPs from list
+func allowedIPsForCDTarget(list []string, deniedRanges []string) []string {
+	denied := map[string]bool{}
+	for _, ip := range deniedIPsForCDTarget(list, deniedRanges) {
+		denied[ip] = true
+	}
+
+	var allowed []string
+	for _, ip := range list {
+		if !denied[ip] {
+			allowed = append(allowed, ip)
+		}
+	}
+
+	return allowed
+}
+
+// allowedPortsForCDTarget removes the denied ports from list
+func allowedPortsForCDTarget(list []int32, deniedPorts []int32) []int32 {
+	var allowed []int32
+
+	for _, p := range list {
+		deny := false
+		for _, d := range deniedPorts {
+			if p == d {
+				deny = true
+				break
+			}
+		}
+		if !deny {
+			allowed = append(allowed, p)
+		}
+	}
+
+	return allowed
+}
+
+// portsConfigMapData renders the ports ConfigMap data from a list of ports
+func portsConfigMapData(list []int32) map[string]string {
+	var ports []string
+	for _, p := range list {
+		ports = append(ports, strconv.Itoa(int(p)))
+	}
+
+	return map[string]string{"ports": strings.Join(ports, "\n")}
+}
+
+// setPoolPolicyIPRanges replaces the IP blocks of the Azure DevOps pool
+// NetworkPolicy with the CIDRs of the operator configuration
+func setPoolPolicyIPRanges(netpol *netv1.NetworkPolicy, ranges []string) {
+	if len(ranges) == 0 {
+		return
+	}
+
+	var peers []netv1.NetworkPolicyPeer
+	for _, cidr := range ranges {
+		peers = append(peers, netv1.NetworkPolicyPeer{
+			IPBlock: &netv1.IPBlock{
+				CIDR: cidr}})
+	}
+
+	for i, rule := range netpol.Spec.Egress {
+		for _, peer := range rule.To {
+			if peer.IPBlock != nil {
+				netpol.Spec.Egress[i].To = peers
+				break
+			}
+		}
+	}
+}
+
+// newPeersForNetworkPolicy counts the peers in desired that are not yet
+// present in the egress rules of the existing NetworkPolicy
+func newPeersForNetworkPolicy(existing, desired *netv1.NetworkPolicy) int {
+	current := map[string]bool{}
+	for _, rule := range existing.Spec.Egress {
+		for _, peer := range rule.To {
+			if peer.IPBlock != nil {
+				current[peer.IPBlock.CIDR] = true
+			}
+		}
+	}
+
+	count := 0
+	for _, rule := range desired.Spec.Egress {
+		for _, peer := range rule.To {
+			if peer.IPBlock != nil && !current[peer.IPBlock.CIDR] {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// getPortsFromConfigMap parses the newline separated ports of the ConfigMap,
+// invalid entries are skipped and reported in the returned error
 func getPortsFromConfigMap(configmap *v1.ConfigMap) ([]int32, error) {
 	var iList []int32
+	var invalid []string
 	portList := configmap.Data["ports"]
 	ports := strings.Split(portList, "\n")
 
 	for _, p := range ports {
+		p = strings.TrimSpace(p)
 		if len(p) != 0 {
-			i, err := strconv.Atoi(p)
-			if err != nil {
-				return iList, err
+			i, err := strconv.ParseInt(p, 10, 32)
+			if err != nil || i < 1 || i > 65535 {
+				invalid = append(invalid, p)
+				continue
 			}
 			iList = append(iList, int32(i))
 		}
 	}
 
+	if len(invalid) > 0 {
+		return iList, fmt.Errorf("invalid ports skipped: %s", strings.Join(invalid, ", "))
+	}
+
 	return iList, nil
 }
 
@@ -77,8 +235,9 @@ func portsForCDTarget(list []int32) []netv1.NetworkPolicyPort {
 }
 
 func (r *CDTargetReconciler) networkPolicyForCDTarget(t *cnadv1alpha1.CDTarget, portList []int32) *netv1.NetworkPolicy {
-	peers := peersForCDTarget(t.Spec.IP)
-	ports := portsForCDTarget(portList)
+	cfg := r.operatorConfig()
+	peers := peersForCDTarget(allowedIPsForCDTarget(t.Spec.IP, cfg.DeniedIPRanges))
+	ports := portsForCDTarget(allowedPortsForCDTarget(portList, cfg.DeniedPorts))
 
 	net := &netv1.NetworkPolicy{
 		ObjectMeta: metav1.ObjectMeta{
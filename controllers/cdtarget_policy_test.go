@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPeersForCDTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      []string
+		cidrs   []string
+		invalid []string
+	}{
+		{name: "IPv4", ip: []string{"10.1.2.3"}, cidrs: []string{"10.1.2.3/32"}},
+		{name: "IPv6", ip: []string{"2001:db8::1"}, cidrs: []string{"2001:db8::1/128"}},
+		{name: "IPv4 mapped IPv6", ip: []string{"::ffff:10.1.2.3"}, cidrs: []string{"10.1.2.3/32"}},
+		{
+			name:    "invalid",
+			ip:      []string{"10.1.2.3", "10.1.2.0/24", "agent.example.com"},
+			cidrs:   []string{"10.1.2.3/32"},
+			invalid: []string{"10.1.2.0/24", "agent.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cidrs []string
+			for _, peer := range peersForCDTarget(tt.ip) {
+				cidrs = append(cidrs, peer.IPBlock.CIDR)
+			}
+			if !reflect.DeepEqual(cidrs, tt.cidrs) {
+				t.Errorf("peersForCDTarget() = %v, want %v", cidrs, tt.cidrs)
+			}
+			if got := invalidIPsForCDTarget(tt.ip); !reflect.DeepEqual(got, tt.invalid) {
+				t.Errorf("invalidIPsForCDTarget() = %v, want %v", got, tt.invalid)
+			}
+		})
+	}
+}
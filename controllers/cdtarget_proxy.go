@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"strings"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// proxySecretRef returns the Secret with the proxy settings of the agents,
+// the credentials of spec.proxy or the deprecated proxyRef
+func proxySecretRef(t *cnadv1alpha1.CDTarget) string {
+	if t.Spec.Proxy != nil {
+		return t.Spec.Proxy.CredentialsRef
+	}
+
+	return t.Spec.ProxyRef
+}
+
+// noProxyForCDTarget returns the NO_PROXY of the agents, the cluster
+// domains and networks and the egress IPs of the CDTarget are reached
+// without the proxy
+func noProxyForCDTarget(t *cnadv1alpha1.CDTarget, cfg *configv1alpha1.OperatorConfig) string {
+	hosts := []string{"localhost", "127.0.0.1", ".svc", "." + cfg.Proxy.ClusterDomain}
+	hosts = append(hosts, cfg.Proxy.ServiceCIDRs...)
+	hosts = append(hosts, cfg.Proxy.PodCIDRs...)
+	hosts = append(hosts, allowedIPsForCDTarget(t.Spec.IP, cfg.DeniedIPRanges)...)
+	hosts = append(hosts, cfg.Proxy.NoProxy...)
+	hosts = append(hosts, t.Spec.Proxy.NoProxy...)
+
+	seen := map[string]bool{}
+	var noProxy []string
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 || seen[host] {
+			continue
+		}
+		seen[host] = true
+		noProxy = append(noProxy, host)
+	}
+
+	return strings.Join(noProxy, ",")
+}
+
+// proxyKeys are the keys of the deprecated proxyRef Secret, every key is
+// passed to the agent as is
+var proxyKeys = []string{"HTTP_PROXY", "HTTPS_PROXY", "PROXY_USER", "PROXY_PW", "PROXY_URL", "FTP_PROXY", "NO_PROXY"}
+
+// proxyEnvForCDTarget returns the proxy environment variables of the agent
+// container, for spec.proxy the lower case variants are added as they are
+// read by curl and most other tools of the pipeline jobs. The proxy URLs are
+// passed without credentials, the agent start script adds the URL encoded
+// PROXY_USER and PROXY_PW as the kubelet substitutes references verbatim
+func proxyEnvForCDTarget(t *cnadv1alpha1.CDTarget, cfg *configv1alpha1.OperatorConfig) []corev1.EnvVar {
+	if t.Spec.Proxy == nil {
+		return secretEnv(t.Spec.ProxyRef, proxyKeys, true)
+	}
+
+	noProxy := noProxyForCDTarget(t, cfg)
+	env := []corev1.EnvVar{
+		{Name: "PROXY_URL", Value: t.Spec.Proxy.URL},
+		{Name: "HTTP_PROXY", Value: t.Spec.Proxy.URL},
+		{Name: "HTTPS_PROXY", Value: t.Spec.Proxy.URL},
+		{Name: "NO_PROXY", Value: noProxy},
+		{Name: "http_proxy", Value: t.Spec.Proxy.URL},
+		{Name: "https_proxy", Value: t.Spec.Proxy.URL},
+		{Name: "no_proxy", Value: noProxy},
+	}
+
+	return append(env, secretEnv(t.Spec.Proxy.CredentialsRef, []string{"PROXY_USER", "PROXY_PW"}, false)...)
+}
+
+// secretEnv returns a variable for every key of the Secret, none when the
+// Secret name is empty
+func secretEnv(name string, keys []string, optional bool) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if len(name) == 0 {
+		return env
+	}
+
+	for _, key := range keys {
+		selector := &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		}
+		if optional {
+			selector.Optional = boolPointer(true)
+		}
+		env = append(env, corev1.EnvVar{Name: key, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: selector}})
+	}
+
+	return env
+}
+
+// mergeEnv concatenates the lists and removes the duplicate names, the last
+// variable with a name wins and takes the position of the first one, so the
+// variables that refer to it keep following it
+func mergeEnv(lists ...[]corev1.EnvVar) []corev1.EnvVar {
+	merged := []corev1.EnvVar{}
+	index := map[string]int{}
+	for _, list := range lists {
+		for _, env := range list {
+			if i, ok := index[env.Name]; ok {
+				merged[i] = env
+				continue
+			}
+			index[env.Name] = len(merged)
+			merged = append(merged, env)
+		}
+	}
+
+	return orderEnvReferences(merged)
+}
+
+// orderEnvReferences moves a variable behind the variables its value refers
+// to, the kubelet only expands references to variables defined before,
+// references in a cycle can not all be expanded and stop the reordering
+// after a pass per variable
+func orderEnvReferences(env []corev1.EnvVar) []corev1.EnvVar {
+	for pass := 0; pass < len(env); pass++ {
+		moved := false
+		for i := range env {
+			last := i
+			for j := i + 1; j < len(env); j++ {
+				if strings.Contains(env[i].Value, "$("+env[j].Name+")") {
+					last = j
+				}
+			}
+			if last == i {
+				continue
+			}
+
+			v := env[i]
+			copy(env[i:last], env[i+1:last+1])
+			env[last] = v
+			moved = true
+			break
+		}
+		if !moved {
+			break
+		}
+	}
+
+	return env
+}
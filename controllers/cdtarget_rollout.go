@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// ContentHashAnnotation is stamped on the agent pod template, a change
+	// of the referenced Secret or ConfigMap content triggers a rollout
+	ContentHashAnnotation = "cnad.gofound.nl/content-hash"
+
+	// secretRefIndex indexes CDTargets by the Secrets they reference
+	secretRefIndex = ".spec.secretRefs"
+
+	// configMapRefIndex indexes CDTargets by the ConfigMaps they reference
+	configMapRefIndex = ".spec.configMapRefs"
+)
+
+// secretRefsForCDTarget returns the names of all Secrets that are
+// consumed by the agent pods of the CDTarget, the tokenRef is only consumed
+// with PAT auth
+func secretRefsForCDTarget(t *cnadv1alpha1.CDTarget) []string {
+	var refs []string
+
+	for _, ref := range []string{credentialSecretRef(t), proxySecretRef(t), t.Spec.CACertRef} {
+		if len(ref) > 0 {
+			refs = append(refs, ref)
+		}
+	}
+	for _, source := range t.Spec.EnvFrom {
+		if source.SecretRef != nil && len(source.SecretRef.Name) > 0 {
+			refs = append(refs, source.SecretRef.Name)
+		}
+	}
+
+	return refs
+}
+
+// credentialSecretRef returns the Secret with the credential the agents
+// register with, empty with workload identity auth
+func credentialSecretRef(t *cnadv1alpha1.CDTarget) string {
+	switch authType(t) {
+	case cnadv1alpha1.AuthPAT:
+		return t.Spec.TokenRef
+	case cnadv1alpha1.AuthServicePrincipal:
+		return t.Spec.Auth.ClientSecretRef
+	}
+
+	return ""
+}
+
+// configMapRefsForCDTarget returns the names of the ConfigMaps in envFrom
+// of the CDTarget, the <name>-config ConfigMap is owned by the CDTarget
+func configMapRefsForCDTarget(t *cnadv1alpha1.CDTarget) []string {
+	var refs []string
+
+	for _, source := range t.Spec.EnvFrom {
+		if source.ConfigMapRef != nil && len(source.ConfigMapRef.Name) > 0 {
+			refs = append(refs, source.ConfigMapRef.Name)
+		}
+	}
+
+	return refs
+}
+
+// credentialFileMounted reports if the credential Secret is mounted as a
+// file, the client secret of a service principal is always mounted
+func credentialFileMounted(t *cnadv1alpha1.CDTarget) bool {
+	return authType(t) == cnadv1alpha1.AuthServicePrincipal || tokenFileMounted(t)
+}
+
+// contentHashForCDTarget hashes the data of the referenced Secrets and the
+// agent config ConfigMap, Secrets that do not exist yet are skipped
+func (r *CDTargetReconciler) contentHashForCDTarget(ctx context.Context,
+	t *cnadv1alpha1.CDTarget, config *corev1.ConfigMap) (string, error) {
+
+	hash := sha256.New()
+	writeData := func(kind, name string, data map[string][]byte) {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(hash, "%s/%s\n", kind, name)
+		for _, k := range keys {
+			fmt.Fprintf(hash, "%s=%x\n", k, data[k])
+		}
+	}
+
+	for _, ref := range secretRefsForCDTarget(t) {
+		// a mounted token or client secret file is updated in place, a PAT
+		// or client secret rotation does not roll out the agents
+		if ref == credentialSecretRef(t) && credentialFileMounted(t) &&
+			ref != proxySecretRef(t) && ref != t.Spec.CACertRef {
+			continue
+		}
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: ref, Namespace: t.Namespace}, secret)
+		if err != nil && errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		writeData("Secret", ref, secret.Data)
+	}
+
+	configMapData := func(cm *corev1.ConfigMap) map[string][]byte {
+		data := map[string][]byte{}
+		for k, v := range cm.Data {
+			data[k] = []byte(v)
+		}
+		for k, v := range cm.BinaryData {
+			data[k] = v
+		}
+		return data
+	}
+	writeData("ConfigMap", config.Name, configMapData(config))
+
+	for _, ref := range configMapRefsForCDTarget(t) {
+		cm := &corev1.ConfigMap{}
+		err := r.Get(ctx, types.NamespacedName{Name: ref, Namespace: t.Namespace}, cm)
+		if err != nil && errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		writeData("ConfigMap", ref, configMapData(cm))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// cdTargetsForSecret maps a Secret event to the CDTargets in the same
+// namespace that reference the Secret
+func (r *CDTargetReconciler) cdTargetsForSecret(obj client.Object) []reconcile.Request {
+	return r.cdTargetsForRef(obj, secretRefIndex)
+}
+
+// cdTargetsForConfigMap maps a ConfigMap event to the CDTargets in the
+// same namespace that reference the ConfigMap in envFrom, a change of the
+// asset overrides in the operator namespace maps to all CDTargets
+func (r *CDTargetReconciler) cdTargetsForConfigMap(obj client.Object) []reconcile.Request {
+	name := r.operatorConfig().Assets.ConfigMapName
+	if len(name) > 0 && obj.GetName() == name && obj.GetNamespace() == r.OperatorNamespace {
+		return r.allCDTargets()
+	}
+
+	return r.cdTargetsForRef(obj, configMapRefIndex)
+}
+
+// allCDTargets returns a request for every CDTarget in the cluster
+func (r *CDTargetReconciler) allCDTargets() []reconcile.Request {
+	list := &cnadv1alpha1.CDTargetList{}
+	if err := r.List(context.Background(), list); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: item.Name, Namespace: item.Namespace},
+		})
+	}
+
+	return requests
+}
+
+func (r *CDTargetReconciler) cdTargetsForRef(obj client.Object, index string) []reconcile.Request {
+	list := &cnadv1alpha1.CDTargetList{}
+	err := r.List(context.Background(), list,
+		client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{index: obj.GetName()})
+	if err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: item.Name, Namespace: item.Namespace},
+		})
+	}
+
+	return requests
+}
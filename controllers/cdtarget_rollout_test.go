@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestSecretRefsForCDTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		auth *cnadv1alpha1.AuthSpec
+		want []string
+	}{
+		{name: "PAT", want: []string{"cdtarget-token", "cdtarget-ca", "extra"}},
+		{
+			name: "service principal",
+			auth: &cnadv1alpha1.AuthSpec{Type: cnadv1alpha1.AuthServicePrincipal, ClientSecretRef: "cdtarget-sp"},
+			want: []string{"cdtarget-sp", "cdtarget-ca", "extra"},
+		},
+		{
+			name: "workload identity",
+			auth: &cnadv1alpha1.AuthSpec{Type: cnadv1alpha1.AuthWorkloadIdentity},
+			want: []string{"cdtarget-ca", "extra"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &cnadv1alpha1.CDTarget{Spec: cnadv1alpha1.CDTargetSpec{
+				TokenRef:  "cdtarget-token",
+				CACertRef: "cdtarget-ca",
+				Auth:      tt.auth,
+				EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "extra"}}}},
+			}}
+			if got := secretRefsForCDTarget(target); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("secretRefsForCDTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCDTargetsForAssetsConfigMap(t *testing.T) {
+	store, err := operatorconfig.NewStore("", &configv1alpha1.OperatorConfig{
+		Assets: configv1alpha1.AssetsConfig{ConfigMapName: "cdtarget-assets"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &CDTargetReconciler{
+		Client: fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(
+			&cnadv1alpha1.CDTarget{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "team-a"}},
+			&cnadv1alpha1.CDTarget{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team-b"}},
+		).Build(),
+		OperatorNamespace: "cdtarget-operator",
+		Config:            store,
+	}
+
+	overrides := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-assets", Namespace: "cdtarget-operator"}}
+	want := []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Name: "a", Namespace: "team-a"}},
+		{NamespacedName: types.NamespacedName{Name: "b", Namespace: "team-b"}},
+	}
+	if got := r.cdTargetsForConfigMap(overrides); !reflect.DeepEqual(got, want) {
+		t.Errorf("cdTargetsForConfigMap() = %v, want %v", got, want)
+	}
+
+	// a ConfigMap with the same name in another namespace is not an override
+	other := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-assets", Namespace: "team-a"}}
+	for _, req := range r.cdTargetsForConfigMap(other) {
+		if req.Namespace != "team-a" {
+			t.Errorf("cdTargetsForConfigMap() maps to %s in another namespace", req)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// TokenAuthorizationAnnotation on the token Secret holds the authorization
+	// id of the PAT the operator issued, manually added PATs have none
+	TokenAuthorizationAnnotation = "cnad.gofound.nl/token-authorization-id"
+
+	// TokenIssuedAnnotation on the token Secret holds the RFC 3339 time the
+	// operator issued the PAT
+	TokenIssuedAnnotation = "cnad.gofound.nl/token-issued-at"
+
+	// TokenRevokePendingAnnotation on the token Secret holds the comma
+	// separated authorization ids of the replaced PATs that are not revoked
+	// yet, it is written with the new PAT so no replaced PAT is lost
+	TokenRevokePendingAnnotation = "cnad.gofound.nl/token-revoke-pending"
+)
+
+// identityURL returns the URL of the PAT lifecycle API of the organization
+var identityURL = azuredevops.IdentityURL
+
+// tokenRotationEnabled reports if the operator issues the PAT of the CDTarget
+func (r *CDTargetReconciler) tokenRotationEnabled(t *cnadv1alpha1.CDTarget) bool {
+	return r.operatorConfig().Token.Rotation.Enabled && t.Spec.RotateToken &&
+		authType(t) == cnadv1alpha1.AuthPAT && len(t.Spec.TokenRef) > 0
+}
+
+// rotationClient returns a client for the PAT lifecycle API of the
+// organization. The API only accepts Azure AD tokens of a user, service
+// principal and managed identity tokens are rejected, the token is
+// redeemed from the refresh token of the user in the credentials Secret and
+// the new refresh token Azure AD returns is written back
+func (r *CDTargetReconciler) rotationClient(ctx context.Context, t *cnadv1alpha1.CDTarget) (*azuredevops.Client, error) {
+	name := r.operatorConfig().Token.Rotation.CredentialsSecretName
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: r.OperatorNamespace}, secret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token rotation credentials %s: %w", name, err)
+	}
+	if len(secret.Data["AZURE_REFRESH_TOKEN"]) == 0 {
+		return nil, fmt.Errorf("token rotation credentials %s have no AZURE_REFRESH_TOKEN, "+
+			"the PAT lifecycle API only accepts user tokens", name)
+	}
+
+	patURL, err := identityURL(t.Spec.Config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	token, refresh, err := azuredevops.RefreshToken(ctx, string(secret.Data["AZURE_TENANT_ID"]),
+		string(secret.Data["AZURE_CLIENT_ID"]), string(secret.Data["AZURE_CLIENT_SECRET"]),
+		string(secret.Data["AZURE_REFRESH_TOKEN"]))
+	if err != nil {
+		return nil, err
+	}
+
+	if refresh != string(secret.Data["AZURE_REFRESH_TOKEN"]) {
+		patch := client.MergeFrom(secret.DeepCopy())
+		secret.Data["AZURE_REFRESH_TOKEN"] = []byte(refresh)
+		if err := r.Patch(ctx, secret, patch); err != nil {
+			return nil, fmt.Errorf("unable to update token rotation credentials %s: %w", name, err)
+		}
+	}
+
+	adc := azuredevops.NewClient(patURL, token)
+	adc.Bearer = true
+	return adc, nil
+}
+
+// rotateToken issues a new PAT into the token Secret when the PAT is not
+// set, has no known expiry or expires within rotateBefore
+func (r *CDTargetReconciler) rotateToken(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	if !r.tokenRotationEnabled(t) {
+		return nil
+	}
+	cfg := r.operatorConfig().Token.Rotation
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: t.Spec.TokenRef, Namespace: t.Namespace}, secret)
+	if err != nil {
+		// the TokenSecret operand creates the Secret
+		return client.IgnoreNotFound(err)
+	}
+
+	if expiry, err := time.Parse(time.RFC3339, secret.Annotations[TokenExpiryAnnotation]); err == nil &&
+		len(secret.Data["AZP_TOKEN"]) > 0 && time.Until(expiry) > cfg.RotateBefore.Duration {
+		return nil
+	}
+
+	adc, err := r.rotationClient(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	pat, err := adc.CreatePAT(ctx, fmt.Sprintf("cdtarget-%s-%s", t.Namespace, t.Name), cfg.Scope,
+		now.Add(cfg.Lifetime.Duration))
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	pending := pendingRevocations(secret)
+	if previous := secret.Annotations[TokenAuthorizationAnnotation]; len(previous) > 0 {
+		pending = append(pending, previous)
+	}
+	setPendingRevocations(secret, pending)
+	secret.Annotations[TokenExpiryAnnotation] = pat.ValidTo.UTC().Format(time.RFC3339)
+	secret.Annotations[TokenAuthorizationAnnotation] = pat.AuthorizationID
+	secret.Annotations[TokenIssuedAnnotation] = now.UTC().Format(time.RFC3339)
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data["AZP_TOKEN"] = []byte(pat.Token)
+	if err = r.Patch(ctx, secret, patch); err != nil {
+		// the issued PAT is not stored, revoke it so it does not leak
+		return utilerrors.NewAggregate([]error{err, adc.RevokePAT(ctx, pat.AuthorizationID)})
+	}
+
+	t.Status.TokenRotations = append(t.Status.TokenRotations, cnadv1alpha1.TokenRotation{
+		AuthorizationID: pat.AuthorizationID,
+		IssuedAt:        metav1.NewTime(now),
+		ExpiresAt:       metav1.NewTime(pat.ValidTo),
+	})
+	trimTokenRotations(t, int(*cfg.HistoryLimit))
+
+	r.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonTokenRotated,
+		"PAT in Secret %s rotated, valid until %s", secret.Name, pat.ValidTo.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// pendingRevocations returns the authorization ids of the replaced PATs
+// that are not revoked yet
+func pendingRevocations(secret *corev1.Secret) []string {
+	var pending []string
+	for _, id := range strings.Split(secret.Annotations[TokenRevokePendingAnnotation], ",") {
+		if len(id) > 0 {
+			pending = append(pending, id)
+		}
+	}
+
+	return pending
+}
+
+func setPendingRevocations(secret *corev1.Secret, pending []string) {
+	if len(pending) == 0 {
+		delete(secret.Annotations, TokenRevokePendingAnnotation)
+		return
+	}
+	secret.Annotations[TokenRevokePendingAnnotation] = strings.Join(pending, ",")
+}
+
+// agentsRolledOut reports if the agent workload runs the pod template of the
+// current content hash, a Deployment or StatefulSet also has to complete
+// the rollout, new agent Jobs of a ScaledJob use the current template
+func (r *CDTargetReconciler) agentsRolledOut(ctx context.Context, t *cnadv1alpha1.CDTarget) (bool, error) {
+	hash, err := r.contentHashForCDTarget(ctx, t, r.configMapForCDTarget(t))
+	if err != nil {
+		return false, err
+	}
+
+	if agentMode(t) == cnadv1alpha1.ModeJob {
+		sj := &kedav2.ScaledJob{}
+		if err := r.Get(ctx, ownedKey(t), sj); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		return sj.Spec.JobTargetRef != nil &&
+			sj.Spec.JobTargetRef.Template.Annotations[ContentHashAnnotation] == hash, nil
+	}
+
+	var workload client.Object
+	var template *corev1.PodTemplateSpec
+	var rolledOut func() bool
+	if agentMode(t) == cnadv1alpha1.ModeStateful {
+		sts := &appsv1.StatefulSet{}
+		workload, template = sts, &sts.Spec.Template
+		rolledOut = func() bool {
+			return sts.Status.ObservedGeneration >= sts.Generation && sts.Status.UpdatedReplicas == sts.Status.Replicas
+		}
+	} else {
+		deployment := &appsv1.Deployment{}
+		workload, template = deployment, &deployment.Spec.Template
+		rolledOut = func() bool {
+			return deployment.Status.ObservedGeneration >= deployment.Generation &&
+				deployment.Status.UpdatedReplicas == deployment.Status.Replicas
+		}
+	}
+	if err := r.Get(ctx, ownedKey(t), workload); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	return template.Annotations[ContentHashAnnotation] == hash && rolledOut(), nil
+}
+
+// revokeRotatedTokens revokes the replaced PATs once revokeDelay passed since
+// the rotation and the agent workload is rolled out with the content hash
+// of the current token Secret, a mounted token file is updated by the
+// kubelet within revokeDelay
+func (r *CDTargetReconciler) revokeRotatedTokens(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	if !r.tokenRotationEnabled(t) {
+		return nil
+	}
+	cfg := r.operatorConfig().Token.Rotation
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: t.Spec.TokenRef, Namespace: t.Namespace}, secret)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	pending := pendingRevocations(secret)
+	// rotations recorded before the pending annotation existed are only
+	// known from the status
+	known := map[string]bool{secret.Annotations[TokenAuthorizationAnnotation]: true}
+	for _, id := range pending {
+		known[id] = true
+	}
+	for _, rotation := range t.Status.TokenRotations {
+		if rotation.RevokedAt == nil && !known[rotation.AuthorizationID] {
+			pending = append(pending, rotation.AuthorizationID)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	issued, err := time.Parse(time.RFC3339, secret.Annotations[TokenIssuedAnnotation])
+	if err == nil && time.Since(issued) < cfg.RevokeDelay.Duration {
+		return nil
+	}
+	if rolledOut, err := r.agentsRolledOut(ctx, t); err != nil || !rolledOut {
+		return err
+	}
+
+	adc, err := r.rotationClient(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	var remaining []string
+	var errs []error
+	for _, id := range pending {
+		err = adc.RevokePAT(ctx, id)
+		var serr *azuredevops.StatusError
+		if err != nil && !(stderrors.As(err, &serr) && serr.StatusCode == http.StatusNotFound) {
+			remaining = append(remaining, id)
+			errs = append(errs, err)
+			continue
+		}
+
+		now := metav1.NewTime(time.Now())
+		for i := range t.Status.TokenRotations {
+			if t.Status.TokenRotations[i].AuthorizationID == id {
+				t.Status.TokenRotations[i].RevokedAt = &now
+			}
+		}
+		r.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonTokenRevoked,
+			"replaced PAT %s of Secret %s revoked", id, secret.Name)
+	}
+	trimTokenRotations(t, int(*cfg.HistoryLimit))
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	setPendingRevocations(secret, remaining)
+	errs = append(errs, r.Patch(ctx, secret, patch))
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// trimTokenRotations drops the oldest revoked rotations beyond the limit,
+// rotations that are not revoked yet are kept
+func trimTokenRotations(t *cnadv1alpha1.CDTarget, limit int) {
+	rotations := t.Status.TokenRotations
+	for i := 0; len(rotations) > limit && i < len(rotations); {
+		if rotations[i].RevokedAt == nil {
+			i++
+			continue
+		}
+		rotations = append(rotations[:i], rotations[i+1:]...)
+	}
+	t.Status.TokenRotations = rotations
+}
+
+// reportTokenRotation records a failed rotation or revocation, a failed
+// rotation does not stop the reconciliation of the operands
+func (r *CDTargetReconciler) reportTokenRotation(t *cnadv1alpha1.CDTarget, err error) {
+	if err == nil || errors.IsConflict(err) {
+		return
+	}
+
+	r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonTokenRotationFailed,
+		"PAT rotation of Secret %s failed: %s", t.Spec.TokenRef, err.Error())
+}
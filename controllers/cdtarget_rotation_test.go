@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestTrimTokenRotations(t *testing.T) {
+	revoked := &metav1.Time{Time: time.Now()}
+	rotations := func(ids ...string) []cnadv1alpha1.TokenRotation {
+		var list []cnadv1alpha1.TokenRotation
+		for _, id := range ids {
+			rotation := cnadv1alpha1.TokenRotation{AuthorizationID: id}
+			// the ids of revoked rotations start with r
+			if id[0] == 'r' {
+				rotation.RevokedAt = revoked
+			}
+			list = append(list, rotation)
+		}
+		return list
+	}
+
+	tests := []struct {
+		name      string
+		rotations []cnadv1alpha1.TokenRotation
+		limit     int
+		want      []cnadv1alpha1.TokenRotation
+	}{
+		{name: "within limit", rotations: rotations("r1", "p2"), limit: 2, want: rotations("r1", "p2")},
+		{name: "oldest revoked dropped", rotations: rotations("r1", "r2", "r3", "p4"), limit: 2, want: rotations("r3", "p4")},
+		{name: "pending kept", rotations: rotations("p1", "r2", "p3", "r4"), limit: 2, want: rotations("p1", "p3")},
+		{name: "pending beyond limit", rotations: rotations("p1", "p2", "r3", "p4"), limit: 2, want: rotations("p1", "p2", "p4")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &cnadv1alpha1.CDTarget{Status: cnadv1alpha1.CDTargetStatus{TokenRotations: tt.rotations}}
+			trimTokenRotations(target, tt.limit)
+			if !reflect.DeepEqual(target.Status.TokenRotations, tt.want) {
+				t.Errorf("trimTokenRotations() = %v, want %v", target.Status.TokenRotations, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokeRotatedTokens(t *testing.T) {
+	var revoked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/tenant/oauth2/v2.0/token" && req.FormValue("refresh_token") == "refresh-1":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "aad-token", "refresh_token": "refresh-2"})
+		case req.Method == http.MethodDelete && req.URL.Path == "/org/_apis/tokens/pats" &&
+			req.Header.Get("Authorization") == "Bearer aad-token":
+			revoked = append(revoked, req.URL.Query().Get("authorizationId"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host, url := azuredevops.AuthorityHost, identityURL
+	azuredevops.AuthorityHost = server.URL
+	identityURL = func(string) (string, error) { return server.URL + "/org", nil }
+	defer func() { azuredevops.AuthorityHost, identityURL = host, url }()
+
+	store, err := operatorconfig.NewStore("", &configv1alpha1.OperatorConfig{
+		Token: configv1alpha1.TokenConfig{Rotation: configv1alpha1.TokenRotationConfig{Enabled: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := &cnadv1alpha1.CDTarget{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Namespace: "test"},
+		Spec: cnadv1alpha1.CDTargetSpec{
+			TokenRef:    "cdtarget-token",
+			RotateToken: true,
+			Config:      cnadv1alpha1.AgentConfig{URL: "https://dev.azure.com/org", PoolName: "build"},
+		},
+		Status: cnadv1alpha1.CDTargetStatus{TokenRotations: []cnadv1alpha1.TokenRotation{
+			{AuthorizationID: "auth-1"}, {AuthorizationID: "auth-2"}}},
+	}
+	token := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-token", Namespace: "test", Annotations: map[string]string{
+			TokenAuthorizationAnnotation: "auth-2",
+			TokenRevokePendingAnnotation: "auth-1",
+			TokenIssuedAnnotation:        time.Now().UTC().Format(time.RFC3339),
+		}},
+		Data: map[string][]byte{"AZP_TOKEN": []byte("pat-2")},
+	}
+	credentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: operatorconfig.DefaultTokenRotationSecretName, Namespace: "cdtarget-operator"},
+		Data: map[string][]byte{"AZURE_TENANT_ID": []byte("tenant"), "AZURE_CLIENT_ID": []byte("client"),
+			"AZURE_REFRESH_TOKEN": []byte("refresh-1")},
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Namespace: "test"},
+		Spec:       appsv1.DeploymentSpec{Replicas: pointer.Int32(2)},
+		Status:     appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 1},
+	}
+
+	ctx := context.Background()
+	r := &CDTargetReconciler{
+		Client: fake.NewClientBuilder().WithScheme(newTestScheme(t)).
+			WithObjects(target, token, credentials, deployment).Build(),
+		Recorder:          record.NewFakeRecorder(10),
+		OperatorNamespace: "cdtarget-operator",
+		Config:            store,
+	}
+	hash, err := r.contentHashForCDTarget(ctx, target, r.configMapForCDTarget(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Template.Annotations = map[string]string{ContentHashAnnotation: hash}
+	if err := r.Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		prepare func()
+		revoked []string
+	}{
+		{name: "within the revoke delay", prepare: func() {}},
+		{
+			name: "rollout in progress",
+			prepare: func() {
+				token.Annotations[TokenIssuedAnnotation] = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+				if err := r.Update(ctx, token); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "rolled out",
+			prepare: func() {
+				deployment.Status.UpdatedReplicas = 2
+				if err := r.Status().Update(ctx, deployment); err != nil {
+					t.Fatal(err)
+				}
+			},
+			revoked: []string{"auth-1"},
+		},
+	}
+
+	for _, step := range steps {
+		step.prepare()
+		if err := r.revokeRotatedTokens(ctx, target); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(revoked, step.revoked) {
+			t.Fatalf("%s: revoked %v, want %v", step.name, revoked, step.revoked)
+		}
+	}
+
+	live := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(token), live); err != nil {
+		t.Fatal(err)
+	}
+	if pending := live.Annotations[TokenRevokePendingAnnotation]; len(pending) > 0 {
+		t.Errorf("pending revocations left: %s", pending)
+	}
+	// the redeemed refresh token is replaced
+	if err := r.Get(ctx, client.ObjectKeyFromObject(credentials), live); err != nil {
+		t.Fatal(err)
+	}
+	if refresh := string(live.Data["AZURE_REFRESH_TOKEN"]); refresh != "refresh-2" {
+		t.Errorf("refresh token = %s, want refresh-2", refresh)
+	}
+	if target.Status.TokenRotations[0].RevokedAt == nil || target.Status.TokenRotations[1].RevokedAt != nil {
+		t.Errorf("revoked rotations not recorded: %v", target.Status.TokenRotations)
+	}
+}
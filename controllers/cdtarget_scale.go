@@ -5,6 +5,8 @@ import (
 
 	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
 	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,9 +30,7 @@ func (r *CDTargetReconciler) scaledObjectForCDTarget(t *cnadv1alpha1.CDTarget) *
 			Labels:    t.Spec.AdditionalSelector,
 		},
 		Spec: kedav2.ScaledObjectSpec{
-			ScaleTargetRef: &kedav2.ScaleTarget{
-				Name: t.Name,
-			},
+			ScaleTargetRef:  scaleTargetForCDTarget(t),
 			MinReplicaCount: t.Spec.MinReplicaCount,
 			MaxReplicaCount: t.Spec.MaxReplicaCount,
 			Triggers: []kedav2.ScaleTriggers{{
@@ -46,6 +46,70 @@ func (r *CDTargetReconciler) scaledObjectForCDTarget(t *cnadv1alpha1.CDTarget) *
 	return so
 }
 
+// agentMode returns the workload mode of the agents
+func agentMode(t *cnadv1alpha1.CDTarget) string {
+	if len(t.Spec.Mode) == 0 {
+		return cnadv1alpha1.ModeDeployment
+	}
+
+	return t.Spec.Mode
+}
+
+// scaleTargetForCDTarget returns the agent workload scaled by the ScaledObject
+func scaleTargetForCDTarget(t *cnadv1alpha1.CDTarget) *kedav2.ScaleTarget {
+	if agentMode(t) == cnadv1alpha1.ModeStateful {
+		return &kedav2.ScaleTarget{Name: t.Name, Kind: "StatefulSet", APIVersion: "apps/v1"}
+	}
+
+	return &kedav2.ScaleTarget{Name: t.Name}
+}
+
+// scaledJobForCDTarget runs the agent pod template of the Deployment as a
+// Job per queued pipeline job, the agent exits after a single job
+func (r *CDTargetReconciler) scaledJobForCDTarget(t *cnadv1alpha1.CDTarget) *kedav2.ScaledJob {
+	so := r.scaledObjectForCDTarget(t)
+
+	template := r.deploymentForCDTarget(t).Spec.Template
+	template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	for i, container := range template.Spec.Containers {
+		if container.Name == "agent" {
+			template.Spec.Containers[i].Args = append(template.Spec.Containers[i].Args, "--once")
+		}
+	}
+
+	job := cnadv1alpha1.JobSpec{}
+	if t.Spec.Job != nil {
+		job = *t.Spec.Job
+	}
+
+	sj := &kedav2.ScaledJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      t.Name,
+			Namespace: t.Namespace,
+			Labels:    t.Spec.AdditionalSelector,
+		},
+		Spec: kedav2.ScaledJobSpec{
+			JobTargetRef: &batchv1.JobSpec{
+				ActiveDeadlineSeconds: job.ActiveDeadlineSeconds,
+				Template:              template,
+			},
+			PollingInterval:            job.PollingInterval,
+			SuccessfulJobsHistoryLimit: job.SuccessfulJobsHistoryLimit,
+			FailedJobsHistoryLimit:     job.FailedJobsHistoryLimit,
+			MinReplicaCount:            t.Spec.MinReplicaCount,
+			MaxReplicaCount:            t.Spec.MaxReplicaCount,
+			ScalingStrategy: kedav2.ScalingStrategy{
+				Strategy:                          job.ScalingStrategy.Strategy,
+				CustomScalingQueueLengthDeduction: job.ScalingStrategy.CustomScalingQueueLengthDeduction,
+				CustomScalingRunningJobPercentage: job.ScalingStrategy.CustomScalingRunningJobPercentage,
+			},
+			Triggers: so.Spec.Triggers,
+		},
+	}
+
+	return sj
+}
+
 func (r *CDTargetReconciler) triggerAuthenticationForCDTarget(t *cnadv1alpha1.CDTarget) *kedav2.TriggerAuthentication {
 
 	name := fmt.Sprintf("%s-trigger-auth", t.Spec.Config.PoolName)
@@ -65,5 +129,10 @@ func (r *CDTargetReconciler) triggerAuthenticationForCDTarget(t *cnadv1alpha1.CD
 		},
 	}
 
+	if identity := triggerAuthenticationIdentity(t); identity != nil {
+		ta.Spec.PodIdentity = identity
+		ta.Spec.SecretTargetRef = nil
+	}
+
 	return ta
 }
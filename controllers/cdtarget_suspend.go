@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// SuspendAnnotation suspends the reconciliation of a CDTarget when set to "true"
+	SuspendAnnotation = "cnad.gofound.nl/suspend"
+	// ConditionSuspended reports if the reconciliation of a CDTarget is suspended
+	ConditionSuspended = "Suspended"
+
+	kedaPausedReplicasAnnotation = "autoscaling.keda.sh/paused-replicas"
+	kedaPausedAnnotation         = "autoscaling.keda.sh/paused"
+
+	// pausedMaxReplicaCountAnnotation keeps the maxReplicaCount of a paused
+	// ScaledJob, empty when it was not set
+	pausedMaxReplicaCountAnnotation = "cnad.gofound.nl/paused-max-replica-count"
+)
+
+// isSuspended reports if the operands of the CDTarget must not be mutated
+func isSuspended(t *cnadv1alpha1.CDTarget) bool {
+	return t.Spec.Suspend || t.Annotations[SuspendAnnotation] == "true"
+}
+
+// setScaledObjectPaused adds or removes the KEDA paused-replicas annotation
+// that pauses the ScaledObject at zero replicas, a missing ScaledObject is ignored
+func (r *CDTargetReconciler) setScaledObjectPaused(ctx context.Context, t *cnadv1alpha1.CDTarget, paused bool) (bool, error) {
+	so := &kedav2.ScaledObject{}
+	err := r.Get(ctx, types.NamespacedName{Name: t.Name, Namespace: t.Namespace}, so)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if _, ok := so.Annotations[kedaPausedReplicasAnnotation]; ok == paused {
+		return false, nil
+	}
+
+	patch := client.MergeFrom(so.DeepCopy())
+	if paused {
+		if so.Annotations == nil {
+			so.Annotations = map[string]string{}
+		}
+		so.Annotations[kedaPausedReplicasAnnotation] = "0"
+	} else {
+		delete(so.Annotations, kedaPausedReplicasAnnotation)
+	}
+
+	return true, r.Patch(ctx, so, patch)
+}
+
+// setScaledJobPaused pauses the ScaledJob of job mode with the KEDA paused
+// annotation, KEDA versions before 2.13 ignore it for ScaledJobs so
+// maxReplicaCount is set to zero as well and restored when it is resumed
+func (r *CDTargetReconciler) setScaledJobPaused(ctx context.Context, t *cnadv1alpha1.CDTarget, paused bool) (bool, error) {
+	sj := &kedav2.ScaledJob{}
+	err := r.Get(ctx, types.NamespacedName{Name: t.Name, Namespace: t.Namespace}, sj)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	previous, ok := sj.Annotations[pausedMaxReplicaCountAnnotation]
+	if ok == paused {
+		return false, nil
+	}
+
+	patch := client.MergeFrom(sj.DeepCopy())
+	if paused {
+		if sj.Annotations == nil {
+			sj.Annotations = map[string]string{}
+		}
+		sj.Annotations[pausedMaxReplicaCountAnnotation] = ""
+		if sj.Spec.MaxReplicaCount != nil {
+			sj.Annotations[pausedMaxReplicaCountAnnotation] = strconv.Itoa(int(*sj.Spec.MaxReplicaCount))
+		}
+		sj.Annotations[kedaPausedAnnotation] = "true"
+		sj.Spec.MaxReplicaCount = pointer.Int32(0)
+	} else {
+		sj.Spec.MaxReplicaCount = nil
+		if n, err := strconv.Atoi(previous); err == nil {
+			sj.Spec.MaxReplicaCount = pointer.Int32(int32(n))
+		}
+		delete(sj.Annotations, pausedMaxReplicaCountAnnotation)
+		delete(sj.Annotations, kedaPausedAnnotation)
+	}
+
+	return true, r.Patch(ctx, sj, patch)
+}
+
+// setAgentsPaused pauses or resumes the KEDA scaler of the agent mode
+func (r *CDTargetReconciler) setAgentsPaused(ctx context.Context, t *cnadv1alpha1.CDTarget, paused bool) (bool, error) {
+	if agentMode(t) == cnadv1alpha1.ModeJob {
+		return r.setScaledJobPaused(ctx, t, paused)
+	}
+
+	return r.setScaledObjectPaused(ctx, t, paused)
+}
+
+// suspendCDTarget leaves the operands untouched, optionally pauses the agents
+// at zero replicas and reports the Suspended condition
+func (r *CDTargetReconciler) suspendCDTarget(ctx context.Context, t *cnadv1alpha1.CDTarget) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	changed, err := r.setAgentsPaused(ctx, t, t.Spec.SuspendScaleToZero)
+	if err != nil {
+		logger.Error(err, "Failed to update the KEDA pause of the agents")
+		return ctrl.Result{}, err
+	}
+	if changed && t.Spec.SuspendScaleToZero {
+		kind := "ScaledObject"
+		if agentMode(t) == cnadv1alpha1.ModeJob {
+			kind = "ScaledJob"
+		}
+		r.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonSuspended,
+			"%s %s paused at zero replicas", kind, t.Name)
+	}
+
+	message := "reconciliation suspended, operands are not updated"
+	if t.Spec.SuspendScaleToZero {
+		message = "reconciliation suspended, agents are scaled to zero"
+	}
+
+	if !meta.IsStatusConditionTrue(t.Status.Conditions, ConditionSuspended) {
+		logger.Info(fmt.Sprintf("Reconciliation of CDTarget %s suspended", t.Name))
+		r.Recorder.Event(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonSuspended, message)
+	}
+
+	meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+		Type:               ConditionSuspended,
+		Status:             metav1.ConditionTrue,
+		Reason:             cnadv1alpha1.ReasonSuspended,
+		LastTransitionTime: metav1.NewTime(time.Now()),
+		Message:            message,
+	})
+
+	return ctrl.Result{}, r.updateStatus(ctx, t)
+}
+
+// resumeCDTarget removes the KEDA pause of a previously suspended CDTarget,
+// the Suspended condition is persisted with the final status update
+func (r *CDTargetReconciler) resumeCDTarget(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	if !meta.IsStatusConditionTrue(t.Status.Conditions, ConditionSuspended) {
+		return nil
+	}
+
+	if _, err := r.setAgentsPaused(ctx, t, false); err != nil {
+		return err
+	}
+
+	log.FromContext(ctx).Info(fmt.Sprintf("Reconciliation of CDTarget %s resumed", t.Name))
+	r.Recorder.Event(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonResumed, "reconciliation resumed")
+	meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+		Type:               ConditionSuspended,
+		Status:             metav1.ConditionFalse,
+		Reason:             cnadv1alpha1.ReasonResumed,
+		LastTransitionTime: metav1.NewTime(time.Now()),
+		Message:            "reconciliation resumed",
+	})
+
+	return nil
+}
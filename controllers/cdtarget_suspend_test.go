@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSetScaledJobPaused(t *testing.T) {
+	tests := []struct {
+		name string
+		max  *int32
+	}{
+		{name: "maxReplicaCount set", max: pointer.Int32(10)},
+		{name: "maxReplicaCount not set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			scheme := runtime.NewScheme()
+			if err := kedav2.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			sj := &kedav2.ScaledJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Namespace: "test"},
+				Spec:       kedav2.ScaledJobSpec{MaxReplicaCount: tt.max},
+			}
+			r := &CDTargetReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(sj).Build()}
+			target := &cnadv1alpha1.CDTarget{Spec: cnadv1alpha1.CDTargetSpec{Mode: cnadv1alpha1.ModeJob}}
+			target.Name, target.Namespace = "cdtarget", "test"
+
+			for _, paused := range []bool{true, true} {
+				if _, err := r.setAgentsPaused(ctx, target, paused); err != nil {
+					t.Fatal(err)
+				}
+			}
+			live := &kedav2.ScaledJob{}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(sj), live); err != nil {
+				t.Fatal(err)
+			}
+			if live.Spec.MaxReplicaCount == nil || *live.Spec.MaxReplicaCount != 0 ||
+				live.Annotations[kedaPausedAnnotation] != "true" {
+				t.Errorf("ScaledJob not paused: maxReplicaCount %v, annotations %v",
+					live.Spec.MaxReplicaCount, live.Annotations)
+			}
+
+			changed, err := r.setAgentsPaused(ctx, target, false)
+			if err != nil || !changed {
+				t.Fatalf("resume changed %v: %v", changed, err)
+			}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(sj), live); err != nil {
+				t.Fatal(err)
+			}
+			if (tt.max == nil) != (live.Spec.MaxReplicaCount == nil) ||
+				(tt.max != nil && *live.Spec.MaxReplicaCount != *tt.max) {
+				t.Errorf("maxReplicaCount = %v, want %v", live.Spec.MaxReplicaCount, tt.max)
+			}
+			if len(live.Annotations) > 0 {
+				t.Errorf("pause annotations left: %v", live.Annotations)
+			}
+		})
+	}
+}
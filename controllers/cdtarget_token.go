@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/azuredevops"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// TokenValidCondition reports if the token of the CDTarget is accepted
+	// by Azure DevOps, the agents are not rolled out while it is false
+	TokenValidCondition = "TokenValid"
+
+	// TokenExpiryAnnotation on the token Secret holds the RFC 3339 expiry of the PAT
+	TokenExpiryAnnotation = "cnad.gofound.nl/token-expiry"
+
+	// maxTokenErrorLength limits the errors other than Azure DevOps status
+	// errors in the TokenValid condition and events
+	maxTokenErrorLength = 256
+)
+
+// tokenCheck is the cached result of a token validation, the token is
+// validated again when its Secret changes or the validation interval passed
+type tokenCheck struct {
+	resourceVersion string
+	checked         time.Time
+	err             error
+}
+
+// cachedTokenCheck returns the validation result of the unchanged token
+// Secret, false when the token has to be validated
+func (r *CDTargetReconciler) cachedTokenCheck(key types.NamespacedName, resourceVersion string) (tokenCheck, bool) {
+	r.tokenChecksMu.Lock()
+	defer r.tokenChecksMu.Unlock()
+
+	check, ok := r.tokenChecks[key]
+	interval := r.operatorConfig().Token.ValidationInterval.Duration
+	if !ok || check.resourceVersion != resourceVersion || time.Since(check.checked) > interval {
+		return tokenCheck{}, false
+	}
+
+	return check, true
+}
+
+func (r *CDTargetReconciler) storeTokenCheck(key types.NamespacedName, check tokenCheck) {
+	r.tokenChecksMu.Lock()
+	defer r.tokenChecksMu.Unlock()
+
+	if r.tokenChecks == nil {
+		r.tokenChecks = map[types.NamespacedName]tokenCheck{}
+	}
+	if len(check.resourceVersion) == 0 {
+		delete(r.tokenChecks, key)
+		return
+	}
+	r.tokenChecks[key] = check
+}
+
+// verifyToken calls the connectionData and agent pools endpoints of the
+// organization with the credentials of the CDTarget
+func verifyToken(ctx context.Context, adc *azuredevops.Client, poolName string) error {
+	if _, err := adc.ConnectionData(ctx); err != nil {
+		return err
+	}
+
+	_, err := adc.PoolID(ctx, poolName)
+	return err
+}
+
+// tokenRejected reports if the validation error means the token is not
+// usable, other errors leave the token unverified
+func tokenRejected(err error) bool {
+	var serr *azuredevops.StatusError
+	return stderrors.Is(err, azuredevops.ErrPoolNotFound) || (stderrors.As(err, &serr) && serr.Unauthorized())
+}
+
+// tokenErrorMessage reduces a validation error to the status code and a
+// short reason, the response body of Azure DevOps can be a full HTML page
+func tokenErrorMessage(err error) string {
+	var serr *azuredevops.StatusError
+	if stderrors.As(err, &serr) {
+		reason := http.StatusText(serr.StatusCode)
+		if serr.StatusCode == http.StatusNonAuthoritativeInfo {
+			reason = "redirected to the sign-in page"
+		}
+		return fmt.Sprintf("azure devops %s %s: status %d %s", serr.Method, serr.Path, serr.StatusCode, reason)
+	}
+
+	message := err.Error()
+	if len(message) > maxTokenErrorLength {
+		message = message[:maxTokenErrorLength] + "..."
+	}
+	return message
+}
+
+// checkToken validates the token of the CDTarget against Azure DevOps and
+// sets the TokenValid condition, it returns the interval after which the
+// token has to be validated again
+func (r *CDTargetReconciler) checkToken(ctx context.Context, t *cnadv1alpha1.CDTarget) time.Duration {
+	key := types.NamespacedName{Name: t.Name, Namespace: t.Namespace}
+	interval := r.operatorConfig().Token.ValidationInterval.Duration
+
+	setCondition := func(status metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+			Type:               TokenValidCondition,
+			Status:             status,
+			Reason:             reason,
+			LastTransitionTime: metav1.NewTime(time.Now()),
+			Message:            message,
+		})
+	}
+
+	secretName, secretKey := t.Spec.TokenRef, "AZP_TOKEN"
+	switch authType(t) {
+	case cnadv1alpha1.AuthWorkloadIdentity:
+		t.Status.TokenExpiry = nil
+		metrics.TokenExpiryTimestamp.DeleteLabelValues(t.Namespace, t.Name)
+		setCondition(metav1.ConditionUnknown, cnadv1alpha1.ReasonTokenNotVerified,
+			"the operator can not verify workload identity credentials")
+		return 0
+	case cnadv1alpha1.AuthServicePrincipal:
+		secretName, secretKey = t.Spec.Auth.ClientSecretRef, "AZURE_CLIENT_SECRET"
+	}
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: t.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		setCondition(metav1.ConditionUnknown, cnadv1alpha1.ReasonTokenNotVerified,
+			fmt.Sprintf("unable to get Secret %s: %s", secretName, err.Error()))
+		return interval
+	}
+	if len(secret.Data[secretKey]) == 0 {
+		r.storeTokenCheck(key, tokenCheck{})
+		setCondition(metav1.ConditionFalse, cnadv1alpha1.ReasonTokenNotSet,
+			fmt.Sprintf("no %s in Secret %s", secretKey, secretName))
+		return interval
+	}
+
+	check, cached := r.cachedTokenCheck(key, secret.ResourceVersion)
+
+	// the expiry of a PAT is not available with the PAT itself, it is read
+	// from the annotation of the token Secret
+	var expiry *time.Time
+	if value, ok := secret.Annotations[TokenExpiryAnnotation]; ok && authType(t) == cnadv1alpha1.AuthPAT {
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			expiry = &parsed
+		} else if !cached {
+			r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonTokenNotVerified,
+				"invalid %s annotation on Secret %s: %s", TokenExpiryAnnotation, secretName, err.Error())
+		}
+	}
+	t.Status.TokenExpiry = nil
+	metrics.TokenExpiryTimestamp.DeleteLabelValues(t.Namespace, t.Name)
+	if expiry != nil {
+		t.Status.TokenExpiry = &metav1.Time{Time: *expiry}
+		metrics.TokenExpiryTimestamp.WithLabelValues(t.Namespace, t.Name).Set(float64(expiry.Unix()))
+	}
+
+	if !cached {
+		check = tokenCheck{resourceVersion: secret.ResourceVersion, checked: time.Now()}
+		adc, err := clientForCDTarget(ctx, r.Client, t)
+		if err == nil && adc != nil {
+			err = verifyToken(ctx, adc, t.Spec.Config.PoolName)
+		}
+		check.err = err
+		r.storeTokenCheck(key, check)
+	}
+
+	switch {
+	case check.err != nil && tokenRejected(check.err):
+		if !cached {
+			r.Recorder.Eventf(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonTokenInvalid,
+				"token in Secret %s rejected by %s: %s", secretName, t.Spec.Config.URL, tokenErrorMessage(check.err))
+		}
+		setCondition(metav1.ConditionFalse, cnadv1alpha1.ReasonTokenInvalid, tokenErrorMessage(check.err))
+		return interval
+	case expiry != nil && time.Now().After(*expiry):
+		message := fmt.Sprintf("token in Secret %s expired at %s", secretName, expiry.Format(time.RFC3339))
+		if !cached {
+			r.Recorder.Event(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonTokenExpired, message)
+		}
+		setCondition(metav1.ConditionFalse, cnadv1alpha1.ReasonTokenExpired, message)
+		return interval
+	case check.err != nil:
+		// Azure DevOps is not reachable, the agents are not held back
+		setCondition(metav1.ConditionUnknown, cnadv1alpha1.ReasonTokenNotVerified, tokenErrorMessage(check.err))
+		return interval
+	}
+
+	warningDays := *r.operatorConfig().Token.ExpiryWarningDays
+	if expiry != nil && time.Until(*expiry) < time.Duration(warningDays)*24*time.Hour {
+		days := int(math.Ceil(time.Until(*expiry).Hours() / 24))
+		message := fmt.Sprintf("token in Secret %s expires in %d days at %s",
+			secretName, days, expiry.Format(time.RFC3339))
+		if !cached {
+			r.Recorder.Event(t, corev1.EventTypeWarning, cnadv1alpha1.ReasonTokenExpiring, message)
+		}
+		setCondition(metav1.ConditionTrue, cnadv1alpha1.ReasonTokenExpiring, message)
+		return interval
+	}
+
+	setCondition(metav1.ConditionTrue, cnadv1alpha1.ReasonTokenValid,
+		fmt.Sprintf("token in Secret %s is valid for pool %s", secretName, t.Spec.Config.PoolName))
+	return interval
+}
+
+// holdRollout returns an OperandError while the token is not valid, the
+// agents are not created or updated until the token is accepted
+func holdRollout(t *cnadv1alpha1.CDTarget) error {
+	c := meta.FindStatusCondition(t.Status.Conditions, TokenValidCondition)
+	if c == nil || c.Status != metav1.ConditionFalse {
+		return nil
+	}
+
+	return &OperandError{Reason: c.Reason, Message: "agent rollout held back until the token is valid",
+		Err: stderrors.New(c.Message)}
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// organization serves the connectionData and pools endpoints with the
+// status of the organization and counts the validations
+type organization struct {
+	status      int32
+	validations int32
+}
+
+func (o *organization) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if status := int(atomic.LoadInt32(&o.status)); status != http.StatusOK {
+		w.WriteHeader(status)
+		w.Write([]byte("<html>" + strings.Repeat("sign in ", 200) + "</html>"))
+		return
+	}
+
+	switch req.URL.Path {
+	case "/org/_apis/connectionData":
+		atomic.AddInt32(&o.validations, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	case "/org/_apis/distributedtask/pools":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"count": 1, "value": []map[string]interface{}{{"id": 7, "name": "build"}}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		expiry time.Duration
+		want   metav1.ConditionStatus
+		reason string
+		held   bool
+	}{
+		{name: "valid", status: http.StatusOK, want: metav1.ConditionTrue, reason: cnadv1alpha1.ReasonTokenValid},
+		{
+			name: "expiring", status: http.StatusOK, expiry: 3 * 24 * time.Hour,
+			want: metav1.ConditionTrue, reason: cnadv1alpha1.ReasonTokenExpiring,
+		},
+		{
+			name: "expired", status: http.StatusOK, expiry: -time.Hour,
+			want: metav1.ConditionFalse, reason: cnadv1alpha1.ReasonTokenExpired, held: true,
+		},
+		{
+			name: "rejected", status: http.StatusNonAuthoritativeInfo,
+			want: metav1.ConditionFalse, reason: cnadv1alpha1.ReasonTokenInvalid, held: true,
+		},
+		{
+			name: "unreachable", status: http.StatusServiceUnavailable,
+			want: metav1.ConditionUnknown, reason: cnadv1alpha1.ReasonTokenNotVerified,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			org := &organization{status: int32(tt.status)}
+			server := httptest.NewServer(org)
+			defer server.Close()
+
+			target := &cnadv1alpha1.CDTarget{
+				ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Namespace: "test"},
+				Spec: cnadv1alpha1.CDTargetSpec{
+					TokenRef: "cdtarget-token",
+					Config:   cnadv1alpha1.AgentConfig{URL: server.URL + "/org", PoolName: "build"},
+				},
+			}
+			token := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-token", Namespace: "test"},
+				Data:       map[string][]byte{"AZP_TOKEN": []byte("pat")},
+			}
+			if tt.expiry != 0 {
+				token.Annotations = map[string]string{
+					TokenExpiryAnnotation: time.Now().Add(tt.expiry).UTC().Format(time.RFC3339)}
+			}
+			r := &CDTargetReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(token).Build(),
+				Recorder: record.NewFakeRecorder(10),
+			}
+
+			r.checkToken(context.Background(), target)
+
+			c := meta.FindStatusCondition(target.Status.Conditions, TokenValidCondition)
+			if c == nil || c.Status != tt.want || c.Reason != tt.reason {
+				t.Fatalf("TokenValid condition = %v, want %s %s", c, tt.want, tt.reason)
+			}
+			if len(c.Message) > maxTokenErrorLength || strings.Contains(c.Message, "<html>") {
+				t.Errorf("condition message contains the response body: %s", c.Message)
+			}
+			if err := holdRollout(target); (err != nil) != tt.held {
+				t.Errorf("holdRollout() = %v, want held %v", err, tt.held)
+			}
+		})
+	}
+}
+
+func TestCheckTokenCached(t *testing.T) {
+	org := &organization{status: http.StatusOK}
+	server := httptest.NewServer(org)
+	defer server.Close()
+
+	target := &cnadv1alpha1.CDTarget{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget", Namespace: "test"},
+		Spec: cnadv1alpha1.CDTargetSpec{
+			TokenRef: "cdtarget-token",
+			Config:   cnadv1alpha1.AgentConfig{URL: server.URL + "/org", PoolName: "build"},
+		},
+	}
+	token := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdtarget-token", Namespace: "test"},
+		Data:       map[string][]byte{"AZP_TOKEN": []byte("pat")},
+	}
+	r := &CDTargetReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(token).Build(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+	ctx := context.Background()
+
+	// the unchanged Secret is not validated again, the rejected token is
+	// only reported after the Secret changed
+	r.checkToken(ctx, target)
+	atomic.StoreInt32(&org.status, http.StatusUnauthorized)
+	r.checkToken(ctx, target)
+	if n := atomic.LoadInt32(&org.validations); n != 1 {
+		t.Errorf("token validated %d times for an unchanged Secret, want 1", n)
+	}
+	if err := holdRollout(target); err != nil {
+		t.Errorf("holdRollout() = %v for a cached valid token", err)
+	}
+
+	token.Data["AZP_TOKEN"] = []byte("revoked")
+	if err := r.Update(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	r.checkToken(ctx, target)
+	c := meta.FindStatusCondition(target.Status.Conditions, TokenValidCondition)
+	if c == nil || c.Reason != cnadv1alpha1.ReasonTokenInvalid {
+		t.Fatalf("TokenValid condition = %v after the Secret changed, want %s", c, cnadv1alpha1.ReasonTokenInvalid)
+	}
+	if want := "status 401 Unauthorized"; !strings.HasSuffix(c.Message, want) {
+		t.Errorf("condition message = %q, want the status %q", c.Message, want)
+	}
+	if err := holdRollout(target); err == nil {
+		t.Error("holdRollout() = nil for a rejected token")
+	}
+}
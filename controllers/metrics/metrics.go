@@ -12,8 +12,130 @@ var (
 			Help: "Number of total reconciliation attempts",
 		},
 	)
+	StaleAgentsRemovedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stale_agents_removed_total",
+			Help: "Number of stale offline agents removed from the agent pool",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	OperandWritesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "operand_writes_total",
+			Help: "Number of operand create and update requests sent to the API server",
+		},
+		[]string{"operand", "operation"},
+	)
+	OperandWritesSkippedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "operand_writes_skipped_total",
+			Help: "Number of operand writes skipped because the operand was up to date",
+		},
+		[]string{"operand"},
+	)
+	StatusUpdatesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "status_updates_total",
+			Help: "Number of CDTarget status updates, written or skipped because the status was unchanged",
+		},
+		[]string{"result"},
+	)
+	ReconcileDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "cdtarget_reconcile_duration_seconds",
+			Help: "Duration of the CDTarget reconciliations",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	ReconcileErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdtarget_reconcile_errors_total",
+			Help: "Number of failed CDTarget reconciliations by condition reason",
+		},
+		[]string{"namespace", "cdtarget", "reason"},
+	)
+	LastSuccessfulReconcileTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cdtarget_last_successful_reconcile_timestamp_seconds",
+			Help: "Unix time of the last successful CDTarget reconciliation",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	EgressIPs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cdtarget_egress_ips",
+			Help: "Number of egress IPs allowed by the NetworkPolicy of the CDTarget",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	EgressPorts = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cdtarget_egress_ports",
+			Help: "Number of egress ports allowed by the NetworkPolicy of the CDTarget",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	AgentReplicas = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cdtarget_agent_replicas",
+			Help: "Number of agent replicas of the CDTarget",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	TokenExpiryTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cdtarget_token_expiry_timestamp_seconds",
+			Help: "Unix time the token of the CDTarget expires, only set when the expiry is known",
+		},
+		[]string{"namespace", "cdtarget"},
+	)
+	ShardsOwned = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "shards_owned",
+			Help: "Number of namespace shards reconciled by the operator replica",
+		},
+	)
 )
 
 func init() {
 	metrics.Registry.MustRegister(ReconcilesTotal)
+	metrics.Registry.MustRegister(StaleAgentsRemovedTotal)
+	metrics.Registry.MustRegister(OperandWritesTotal)
+	metrics.Registry.MustRegister(OperandWritesSkippedTotal)
+	metrics.Registry.MustRegister(StatusUpdatesTotal)
+	metrics.Registry.MustRegister(ShardsOwned)
+	metrics.Registry.MustRegister(ReconcileDurationSeconds)
+	metrics.Registry.MustRegister(ReconcileErrorsTotal)
+	metrics.Registry.MustRegister(LastSuccessfulReconcileTimestamp)
+	metrics.Registry.MustRegister(EgressIPs)
+	metrics.Registry.MustRegister(EgressPorts)
+	metrics.Registry.MustRegister(AgentReplicas)
+	metrics.Registry.MustRegister(TokenExpiryTimestamp)
+}
+
+// DeleteCDTarget removes the series of a deleted CDTarget
+func DeleteCDTarget(namespace, name string) {
+	labels := prometheus.Labels{"namespace": namespace, "cdtarget": name}
+	ReconcileDurationSeconds.Delete(labels)
+	ReconcileErrorsTotal.DeletePartialMatch(labels)
+	LastSuccessfulReconcileTimestamp.Delete(labels)
+	EgressIPs.Delete(labels)
+	EgressPorts.Delete(labels)
+	AgentReplicas.Delete(labels)
+	TokenExpiryTimestamp.Delete(labels)
+	StaleAgentsRemovedTotal.Delete(labels)
+}
+
+// DeleteNamespace removes the series of all CDTargets in the namespace, the
+// replica that takes over the shard of the namespace exports them again
+func DeleteNamespace(namespace string) {
+	labels := prometheus.Labels{"namespace": namespace}
+	ReconcileDurationSeconds.DeletePartialMatch(labels)
+	ReconcileErrorsTotal.DeletePartialMatch(labels)
+	LastSuccessfulReconcileTimestamp.DeletePartialMatch(labels)
+	EgressIPs.DeletePartialMatch(labels)
+	EgressPorts.DeletePartialMatch(labels)
+	AgentReplicas.DeletePartialMatch(labels)
+	TokenExpiryTimestamp.DeletePartialMatch(labels)
+	StaleAgentsRemovedTotal.DeletePartialMatch(labels)
 }
@@ -0,0 +1,362 @@
+package controllers
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// notReadyRequeueInterval is the requeue interval while an operand is not ready
+const notReadyRequeueInterval = 30 * time.Second
+
+// Operand is a resource the operator manages for a CDTarget, the reconciler
+// runs the operands in order and reports a <Name>Ready condition per operand
+type Operand interface {
+	// Name identifies the operand in the conditions
+	Name() string
+	// Render returns the desired object of the operand
+	Render(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error)
+	// Reconcile creates or updates the operand, a returned OperandError
+	// sets the reason of the failed condition
+	Reconcile(ctx context.Context, t *cnadv1alpha1.CDTarget) error
+	// Ready reports if the operand is ready, the CDTarget is requeued
+	// while an operand is not ready
+	Ready(ctx context.Context, t *cnadv1alpha1.CDTarget) (bool, error)
+	// Cleanup runs when the CDTarget is deleted and reports if it is done,
+	// the CDTarget is requeued until all operands are cleaned up
+	Cleanup(ctx context.Context, t *cnadv1alpha1.CDTarget) (bool, error)
+}
+
+// OperandError is a failed operand with the reason of the condition
+type OperandError struct {
+	Reason  string
+	Message string
+	Err     error
+}
+
+func (e *OperandError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Message, e.Err.Error())
+}
+
+func (e *OperandError) Unwrap() error {
+	return e.Err
+}
+
+// enabler is implemented by operands that are only rendered for some CDTargets
+type enabler interface {
+	Enabled(t *cnadv1alpha1.CDTarget) bool
+}
+
+// operands returns the operands of a CDTarget in reconcile order, the
+// registered Operands run after the built-in operands
+func (r *CDTargetReconciler) operands() []Operand {
+	return append(r.defaultOperands(), r.Operands...)
+}
+
+// reconcileOperands runs the operands in order and stops at the first
+// failed operand
+func (r *CDTargetReconciler) reconcileOperands(ctx context.Context, t *cnadv1alpha1.CDTarget) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	result := ctrl.Result{}
+
+	for _, o := range r.operands() {
+		condition := fmt.Sprintf("%sReady", o.Name())
+
+		if err := o.Reconcile(ctx, t); err != nil {
+			reason, message := cnadv1alpha1.ReasonOperandFailed, err.Error()
+			var oerr *OperandError
+			if stderrors.As(err, &oerr) {
+				reason = oerr.Reason
+			}
+			logger.Error(err, fmt.Sprintf("Failed to reconcile operand %s", o.Name()))
+			for _, c := range []string{condition, "ReconcileSuccess"} {
+				meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+					Type:               c,
+					Status:             metav1.ConditionFalse,
+					Reason:             reason,
+					LastTransitionTime: metav1.NewTime(time.Now()),
+					Message:            message,
+				})
+			}
+			return ctrl.Result{}, utilerrors.NewAggregate([]error{err, r.updateStatus(ctx, t)})
+		}
+
+		// a disabled operand has no condition
+		if e, ok := o.(enabler); ok && !e.Enabled(t) {
+			meta.RemoveStatusCondition(&t.Status.Conditions, condition)
+			continue
+		}
+
+		ready, err := o.Ready(ctx, t)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if ready {
+			meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+				Type:               condition,
+				Status:             metav1.ConditionTrue,
+				Reason:             cnadv1alpha1.ReasonOperandReady,
+				LastTransitionTime: metav1.NewTime(time.Now()),
+				Message:            fmt.Sprintf("operand %s is ready", o.Name()),
+			})
+			continue
+		}
+
+		meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+			Type:               condition,
+			Status:             metav1.ConditionFalse,
+			Reason:             cnadv1alpha1.ReasonOperandNotReady,
+			LastTransitionTime: metav1.NewTime(time.Now()),
+			Message:            fmt.Sprintf("operand %s is not ready", o.Name()),
+		})
+		result.RequeueAfter = notReadyRequeueInterval
+	}
+
+	return result, nil
+}
+
+// cleanupOperands runs the operand cleanup in reverse reconcile order and
+// reports if all operands are cleaned up
+func (r *CDTargetReconciler) cleanupOperands(ctx context.Context, t *cnadv1alpha1.CDTarget) (bool, error) {
+	operands := r.operands()
+	for i := len(operands) - 1; i >= 0; i-- {
+		done, err := operands[i].Cleanup(ctx, t)
+		if err != nil || !done {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// operandReasons are the condition and event reasons of an objectOperand
+type operandReasons struct {
+	NotAvailable string
+	Failed       string
+	Created      string
+	Updated      string
+}
+
+// objectOperand is an Operand backed by a single Kubernetes object
+type objectOperand struct {
+	r       *CDTargetReconciler
+	name    string
+	reasons operandReasons
+	// enabled reports if the CDTarget uses the operand, the owned object of
+	// a disabled operand is deleted, nil is always enabled
+	enabled func(t *cnadv1alpha1.CDTarget) bool
+	// newObject returns an empty object of the operand kind
+	newObject func() client.Object
+	// key returns the name and namespace of the operand
+	key func(t *cnadv1alpha1.CDTarget) types.NamespacedName
+	// render returns the desired object
+	render func(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error)
+	// validate reports problems in the CDTarget input of the operand
+	validate func(ctx context.Context, t *cnadv1alpha1.CDTarget)
+	// update applies the desired state to the live object and reports
+	// if it changed, the live object is only written when it changed,
+	// operands without update are only created
+	update func(live, desired client.Object) bool
+	// created returns the event message after creation
+	created func(t *cnadv1alpha1.CDTarget, obj client.Object) string
+	// updated returns the event message after an update, it is called
+	// before update, an empty message skips the event
+	updated func(t *cnadv1alpha1.CDTarget, live, desired client.Object) string
+	// ready reports if the live object is ready, nil is always ready
+	ready func(live client.Object) bool
+	// cleanup runs on deletion of the CDTarget, nil does nothing
+	cleanup func(ctx context.Context, t *cnadv1alpha1.CDTarget, live client.Object) (bool, error)
+	// owned operands get the CDTarget as controller owner
+	owned bool
+	// planned operands are included in plan mode
+	planned bool
+}
+
+func (o *objectOperand) Name() string {
+	return o.name
+}
+
+func (o *objectOperand) Enabled(t *cnadv1alpha1.CDTarget) bool {
+	return o.enabled == nil || o.enabled(t)
+}
+
+func (o *objectOperand) Render(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+	desired, err := o.render(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.owned {
+		if err = ctrl.SetControllerReference(t, desired, o.r.Scheme); err != nil {
+			return nil, err
+		}
+	}
+
+	return desired, nil
+}
+
+func (o *objectOperand) kind(obj client.Object) string {
+	gvk, err := apiutil.GVKForObject(obj, o.r.Scheme)
+	if err != nil {
+		return o.name
+	}
+
+	return gvk.Kind
+}
+
+func (o *objectOperand) Reconcile(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	logger := log.FromContext(ctx)
+	r := o.r
+
+	if !o.Enabled(t) {
+		return o.remove(ctx, t)
+	}
+
+	if o.validate != nil {
+		o.validate(ctx, t)
+	}
+
+	desired, err := o.Render(ctx, t)
+	if err != nil {
+		var oerr *OperandError
+		if stderrors.As(err, &oerr) {
+			r.Recorder.Event(t, corev1.EventTypeWarning, oerr.Reason, oerr.Error())
+			return err
+		}
+		return o.failed(t, o.reasons.Failed, fmt.Sprintf("unable to render %s", o.name), err)
+	}
+	kind := o.kind(desired)
+
+	live := o.newObject()
+	err = r.Get(ctx, client.ObjectKeyFromObject(desired), live)
+	if err != nil && errors.IsNotFound(err) {
+		logger.Info(fmt.Sprintf("Creating %s %s", kind, desired.GetName()))
+		metrics.OperandWritesTotal.WithLabelValues(o.name, "create").Inc()
+		if err = r.Create(ctx, desired); err != nil {
+			return o.failed(t, o.reasons.Failed,
+				fmt.Sprintf("%s %s creation failed", kind, desired.GetName()), err)
+		}
+		message := fmt.Sprintf("%s %s created", kind, desired.GetName())
+		if o.created != nil {
+			message = o.created(t, desired)
+		}
+		r.Recorder.Event(t, corev1.EventTypeNormal, o.reasons.Created, message)
+		return nil
+	} else if err != nil {
+		return o.failed(t, o.reasons.NotAvailable,
+			fmt.Sprintf("unable to get %s %s", kind, desired.GetName()), err)
+	}
+
+	if o.update == nil {
+		metrics.OperandWritesSkippedTotal.WithLabelValues(o.name).Inc()
+		return nil
+	}
+
+	message := fmt.Sprintf("%s %s updated", kind, desired.GetName())
+	if o.updated != nil {
+		message = o.updated(t, live, desired)
+	}
+
+	patch := client.MergeFrom(live.DeepCopyObject().(client.Object))
+	if !o.update(live, desired) {
+		metrics.OperandWritesSkippedTotal.WithLabelValues(o.name).Inc()
+		return nil
+	}
+
+	metrics.OperandWritesTotal.WithLabelValues(o.name, "update").Inc()
+	if err = r.Patch(ctx, live, patch); err != nil {
+		return o.failed(t, o.reasons.Failed,
+			fmt.Sprintf("%s %s update failed", kind, desired.GetName()), err)
+	}
+
+	if len(message) > 0 {
+		r.Recorder.Event(t, corev1.EventTypeNormal, o.reasons.Updated, message)
+	}
+
+	return nil
+}
+
+// failed records a warning event and returns the OperandError
+func (o *objectOperand) failed(t *cnadv1alpha1.CDTarget, reason, message string, err error) error {
+	oerr := &OperandError{Reason: reason, Message: message, Err: err}
+	o.r.Recorder.Event(t, corev1.EventTypeWarning, reason, oerr.Error())
+	return oerr
+}
+
+// remove deletes the object of a disabled operand when the CDTarget owns it
+func (o *objectOperand) remove(ctx context.Context, t *cnadv1alpha1.CDTarget) error {
+	live, err := o.live(ctx, t)
+	if err != nil || live == nil || !metav1.IsControlledBy(live, t) {
+		return client.IgnoreNotFound(err)
+	}
+
+	log.FromContext(ctx).Info(fmt.Sprintf("Deleting disabled %s %s", o.kind(live), live.GetName()))
+	metrics.OperandWritesTotal.WithLabelValues(o.name, "delete").Inc()
+	if err = o.r.Delete(ctx, live); err != nil && !errors.IsNotFound(err) {
+		return o.failed(t, o.reasons.Failed,
+			fmt.Sprintf("%s %s deletion failed", o.kind(live), live.GetName()), err)
+	}
+	o.r.Recorder.Eventf(t, corev1.EventTypeNormal, cnadv1alpha1.ReasonOperandDeleted,
+		"%s %s deleted", o.kind(live), live.GetName())
+
+	return nil
+}
+
+// live returns the live object of the operand, nil if it does not exist
+func (o *objectOperand) live(ctx context.Context, t *cnadv1alpha1.CDTarget) (client.Object, error) {
+	key := o.key(t)
+	if len(key.Name) == 0 {
+		// the operand is not configured, for example a token Secret without tokenRef
+		return nil, nil
+	}
+
+	live := o.newObject()
+	err := o.r.Get(ctx, key, live)
+	if err != nil && (errors.IsNotFound(err) || meta.IsNoMatchError(err)) {
+		// the object does not exist or its kind is not installed
+		return nil, nil
+	}
+
+	return live, err
+}
+
+func (o *objectOperand) Ready(ctx context.Context, t *cnadv1alpha1.CDTarget) (bool, error) {
+	if o.ready == nil {
+		return true, nil
+	}
+
+	live, err := o.live(ctx, t)
+	if err != nil || live == nil {
+		return false, err
+	}
+
+	return o.ready(live), nil
+}
+
+func (o *objectOperand) Cleanup(ctx context.Context, t *cnadv1alpha1.CDTarget) (bool, error) {
+	if o.cleanup == nil {
+		return true, nil
+	}
+
+	live, err := o.live(ctx, t)
+	if err != nil || live == nil {
+		return err == nil, err
+	}
+
+	return o.cleanup(ctx, t, live)
+}
@@ -0,0 +1,305 @@
+package operatorconfig
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultPortsConfigMapName is the ConfigMap with the allowed egress ports
+	DefaultPortsConfigMapName = "cdtarget-ports"
+	// DefaultConfigReloadInterval is the interval between config file checks
+	DefaultConfigReloadInterval = 30 * time.Second
+	// DefaultDinDImage is the image of the Docker-in-Docker sidecar
+	DefaultDinDImage = "docker:24-dind"
+	// DefaultTokenValidationInterval is the interval between validations
+	// of an unchanged token
+	DefaultTokenValidationInterval = 15 * time.Minute
+	// DefaultTokenExpiryWarningDays is the number of days before the token
+	// expiry the operator starts to warn
+	DefaultTokenExpiryWarningDays = 7
+	// DefaultTokenRotationSecretName holds the credentials of the service
+	// principal that issues the rotated PATs
+	DefaultTokenRotationSecretName = "cdtarget-token-rotation"
+	// DefaultTokenRotationScope is the scope of the rotated PATs, agent
+	// registration and the KEDA scaler need to manage agent pools
+	DefaultTokenRotationScope = "vso.agentpools_manage"
+	// DefaultTokenRotationHistoryLimit is the number of rotations in the status
+	DefaultTokenRotationHistoryLimit = 5
+	// DefaultClusterDomain is the DNS domain of the cluster in NO_PROXY
+	DefaultClusterDomain = "cluster.local"
+)
+
+// DefaultAllowedPodTemplateFields are the spec.podTemplate fields CDTargets
+// can set without podTemplate.allowedFields in the configuration file, the
+// service account, host aliases and the agent extensions require an
+// explicit allowlist
+var DefaultAllowedPodTemplateFields = []string{
+	"nodeSelector", "tolerations", "affinity", "topologySpreadConstraints",
+	"priorityClassName", "securityContext", "containerSecurityContext", "runtimeClassName",
+}
+
+// Store holds the active operator configuration and reloads it when the
+// configuration file changes, the manager settings in the file are only
+// applied at startup
+type Store struct {
+	path     string
+	defaults *configv1alpha1.OperatorConfig
+	codecs   serializer.CodecFactory
+
+	mu       sync.RWMutex
+	current  *configv1alpha1.OperatorConfig
+	content  []byte
+	handlers []func(ctx context.Context)
+}
+
+// NewStore returns a Store for the configuration file at path, an empty
+// path only serves the defaults
+func NewStore(path string, defaults *configv1alpha1.OperatorConfig) (*Store, error) {
+	scheme := runtime.NewScheme()
+	if err := configv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		path:     path,
+		defaults: defaults.DeepCopy(),
+		codecs:   serializer.NewCodecFactory(scheme),
+	}
+	s.current = s.withDefaults(&configv1alpha1.OperatorConfig{})
+
+	if len(path) > 0 {
+		if _, err := s.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Default returns the operator configuration without a configuration file
+func Default() *configv1alpha1.OperatorConfig {
+	s := &Store{defaults: &configv1alpha1.OperatorConfig{}}
+	return s.withDefaults(&configv1alpha1.OperatorConfig{})
+}
+
+// Get returns the active configuration, the returned value is shared
+// and must not be modified
+func (s *Store) Get() *configv1alpha1.OperatorConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current
+}
+
+// Reload reads the configuration file and activates it when the content
+// changed, an invalid file keeps the active configuration
+func (s *Store) Reload() (bool, error) {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, fmt.Errorf("could not read file at %s: %w", s.path, err)
+	}
+
+	s.mu.RLock()
+	unchanged := bytes.Equal(content, s.content)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	loaded := &configv1alpha1.OperatorConfig{}
+	if err = runtime.DecodeInto(s.codecs.UniversalDecoder(), content, loaded); err != nil {
+		return false, fmt.Errorf("could not decode file at %s: %w", s.path, err)
+	}
+
+	if err = loaded.Validate(); err != nil {
+		return false, fmt.Errorf("invalid configuration in %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.current = s.withDefaults(loaded)
+	s.content = content
+	s.mu.Unlock()
+
+	return true, nil
+}
+
+// withDefaults fills the unset fields of c from the store defaults
+func (s *Store) withDefaults(c *configv1alpha1.OperatorConfig) *configv1alpha1.OperatorConfig {
+	d := s.defaults
+
+	if len(c.DefaultAgentImage) == 0 {
+		c.DefaultAgentImage = d.DefaultAgentImage
+	}
+	if len(c.DinDImage) == 0 {
+		c.DinDImage = d.DinDImage
+	}
+	if len(c.DinDImage) == 0 {
+		c.DinDImage = DefaultDinDImage
+	}
+	if len(c.Ports.ConfigMapName) == 0 {
+		c.Ports.ConfigMapName = d.Ports.ConfigMapName
+	}
+	if len(c.Ports.ConfigMapName) == 0 {
+		c.Ports.ConfigMapName = DefaultPortsConfigMapName
+	}
+	if len(c.Ports.Defaults) == 0 {
+		c.Ports.Defaults = d.Ports.Defaults
+	}
+	if len(c.AzureDevOpsIPRanges) == 0 {
+		c.AzureDevOpsIPRanges = d.AzureDevOpsIPRanges
+	}
+	if len(c.DeniedIPRanges) == 0 {
+		c.DeniedIPRanges = d.DeniedIPRanges
+	}
+	if len(c.DeniedPorts) == 0 {
+		c.DeniedPorts = d.DeniedPorts
+	}
+	if len(c.PolicyBackend) == 0 {
+		c.PolicyBackend = configv1alpha1.PolicyBackendNetworkPolicy
+	}
+	if len(c.Assets.ConfigMapName) == 0 {
+		c.Assets.ConfigMapName = d.Assets.ConfigMapName
+	}
+	if len(c.Assets.Directory) == 0 {
+		c.Assets.Directory = d.Assets.Directory
+	}
+	if c.PodTemplate.AllowedFields == nil {
+		c.PodTemplate.AllowedFields = d.PodTemplate.AllowedFields
+	}
+	if c.PodTemplate.AllowedFields == nil {
+		c.PodTemplate.AllowedFields = DefaultAllowedPodTemplateFields
+	}
+	if c.Resync.ReconcileInterval == nil {
+		c.Resync.ReconcileInterval = durationOrDefault(d.Resync.ReconcileInterval, 0)
+	}
+	if c.Resync.StaleAgentSweepInterval == nil {
+		c.Resync.StaleAgentSweepInterval = durationOrDefault(d.Resync.StaleAgentSweepInterval, 0)
+	}
+	if c.Resync.StaleAgentMaxAge == nil {
+		c.Resync.StaleAgentMaxAge = durationOrDefault(d.Resync.StaleAgentMaxAge, time.Hour)
+	}
+	if c.Resync.ConfigReloadInterval == nil {
+		c.Resync.ConfigReloadInterval = durationOrDefault(d.Resync.ConfigReloadInterval, DefaultConfigReloadInterval)
+	}
+	if c.Token.ValidationInterval == nil {
+		c.Token.ValidationInterval = durationOrDefault(d.Token.ValidationInterval, DefaultTokenValidationInterval)
+	}
+	if c.Token.ExpiryWarningDays == nil {
+		c.Token.ExpiryWarningDays = d.Token.ExpiryWarningDays
+	}
+	if c.Token.ExpiryWarningDays == nil {
+		days := int32(DefaultTokenExpiryWarningDays)
+		c.Token.ExpiryWarningDays = &days
+	}
+	rotation, drotation := &c.Token.Rotation, &d.Token.Rotation
+	if !rotation.Enabled {
+		rotation.Enabled = drotation.Enabled
+	}
+	if len(rotation.CredentialsSecretName) == 0 {
+		rotation.CredentialsSecretName = drotation.CredentialsSecretName
+	}
+	if len(rotation.CredentialsSecretName) == 0 {
+		rotation.CredentialsSecretName = DefaultTokenRotationSecretName
+	}
+	if len(rotation.Scope) == 0 {
+		rotation.Scope = drotation.Scope
+	}
+	if len(rotation.Scope) == 0 {
+		rotation.Scope = DefaultTokenRotationScope
+	}
+	if rotation.Lifetime == nil {
+		rotation.Lifetime = durationOrDefault(drotation.Lifetime, 7*24*time.Hour)
+	}
+	if rotation.RotateBefore == nil {
+		rotation.RotateBefore = durationOrDefault(drotation.RotateBefore, 2*24*time.Hour)
+	}
+	if rotation.RevokeDelay == nil {
+		rotation.RevokeDelay = durationOrDefault(drotation.RevokeDelay, 10*time.Minute)
+	}
+	if rotation.HistoryLimit == nil {
+		rotation.HistoryLimit = drotation.HistoryLimit
+	}
+	if rotation.HistoryLimit == nil {
+		limit := int32(DefaultTokenRotationHistoryLimit)
+		rotation.HistoryLimit = &limit
+	}
+	if len(c.Proxy.ServiceCIDRs) == 0 {
+		c.Proxy.ServiceCIDRs = d.Proxy.ServiceCIDRs
+	}
+	if len(c.Proxy.PodCIDRs) == 0 {
+		c.Proxy.PodCIDRs = d.Proxy.PodCIDRs
+	}
+	if len(c.Proxy.ClusterDomain) == 0 {
+		c.Proxy.ClusterDomain = d.Proxy.ClusterDomain
+	}
+	if len(c.Proxy.ClusterDomain) == 0 {
+		c.Proxy.ClusterDomain = DefaultClusterDomain
+	}
+	if len(c.Proxy.NoProxy) == 0 {
+		c.Proxy.NoProxy = d.Proxy.NoProxy
+	}
+
+	return c
+}
+
+func durationOrDefault(d *metav1.Duration, fallback time.Duration) *metav1.Duration {
+	if d != nil {
+		return d.DeepCopy()
+	}
+
+	return &metav1.Duration{Duration: fallback}
+}
+
+// OnReload registers a function that is called when a changed configuration
+// is activated, it must be registered before the Store is started. The
+// functions run in their own goroutine so they do not delay the polling
+func (s *Store) OnReload(f func(ctx context.Context)) {
+	s.handlers = append(s.handlers, f)
+}
+
+// Start polls the configuration file for changes until the context is
+// cancelled, it implements the controller-runtime manager Runnable interface
+func (s *Store) Start(ctx context.Context) error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	logger := log.FromContext(ctx).WithName("operator-config")
+	for {
+		interval := s.Get().Resync.ConfigReloadInterval.Duration
+		if interval <= 0 {
+			interval = DefaultConfigReloadInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+			changed, err := s.Reload()
+			if err != nil {
+				logger.Error(err, "Keeping the active operator configuration")
+			} else if changed {
+				logger.Info("Reloaded operator configuration", "path", s.path)
+				for _, f := range s.handlers {
+					go f(ctx)
+				}
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false so every replica reloads its configuration
+func (s *Store) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,57 @@
+package operatorconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
+)
+
+const testConfig = `apiVersion: config.cnad.gofound.nl/v1alpha1
+kind: OperatorConfig
+resync:
+  configReloadInterval: 10ms
+defaultAgentImage: %s
+`
+
+func TestStoreOnReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controller_manager_config.yaml")
+	write := func(image string) {
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(testConfig, image)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("agent:1")
+
+	s, err := NewStore(path, &configv1alpha1.OperatorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan string, 1)
+	s.OnReload(func(ctx context.Context) { reloaded <- s.Get().DefaultAgentImage })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+
+	// the unchanged file is not reported
+	select {
+	case image := <-reloaded:
+		t.Fatalf("reload reported for an unchanged file with image %s", image)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	write("agent:2")
+	select {
+	case image := <-reloaded:
+		if image != "agent:2" {
+			t.Errorf("reloaded image = %s, want agent:2", image)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not reported")
+	}
+}
@@ -0,0 +1,327 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/metrics"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// MemberLabel marks the Leases that announce a live operator replica
+	MemberLabel = "cnad.gofound.nl/shard-member"
+
+	memberLeasePrefix = "cdtarget-member-"
+	shardLeasePrefix  = "cdtarget-shard-"
+)
+
+// Membership assigns hash partitions of the namespaces to the operator
+// replicas. Every replica renews a member Lease, the shards are spread over
+// the live members and a replica only reconciles the namespaces of the shards
+// it holds the shard Lease of. The Lease of a dead replica expires and its
+// shards are taken over by the remaining replicas.
+type Membership struct {
+	// Client writes the Leases
+	Client client.Client
+	// Reader reads the Leases from the API server instead of the cache
+	Reader client.Reader
+	// Namespace contains the member and shard Leases
+	Namespace string
+	// Identity is the unique name of the replica, usually the pod name
+	Identity string
+	// Shards is the number of namespace partitions
+	Shards int
+	// LeaseDuration is the time a replica keeps a shard without renewal
+	LeaseDuration time.Duration
+	// RenewDeadline is the time a replica reconciles the namespaces of a
+	// shard without renewal, it is shorter than LeaseDuration so the replica
+	// stops before another replica can take over the expired Lease, two
+	// thirds of LeaseDuration when not set
+	RenewDeadline time.Duration
+
+	mu       sync.RWMutex
+	renewed  map[int]time.Time
+	handlers []func(ctx context.Context, shard int)
+	releases []func(ctx context.Context, shard int)
+}
+
+// ShardFor returns the shard of the namespace
+func (m *Membership) ShardFor(namespace string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(namespace))
+	return int(h.Sum32() % uint32(m.Shards))
+}
+
+// Owns reports if the replica reconciles the namespace, a nil Membership
+// owns all namespaces
+func (m *Membership) Owns(namespace string) bool {
+	if m == nil {
+		return true
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	renewed, ok := m.renewed[m.ShardFor(namespace)]
+	return ok && time.Since(renewed) < m.renewDeadline()
+}
+
+func (m *Membership) renewDeadline() time.Duration {
+	if m.RenewDeadline > 0 && m.RenewDeadline < m.LeaseDuration {
+		return m.RenewDeadline
+	}
+
+	return m.LeaseDuration * 2 / 3
+}
+
+// OnAcquire registers a function that is called when the replica acquires a
+// shard, it must be registered before the Membership is started. The
+// functions run in their own goroutine so they do not delay the renewal
+func (m *Membership) OnAcquire(f func(ctx context.Context, shard int)) {
+	m.handlers = append(m.handlers, f)
+}
+
+// OnRelease registers a function that is called when the replica releases or
+// loses a shard while it keeps running, it must be registered before the
+// Membership is started. The functions run in their own goroutine
+func (m *Membership) OnRelease(f func(ctx context.Context, shard int)) {
+	m.releases = append(m.releases, f)
+}
+
+// NeedLeaderElection implements the controller-runtime LeaderElectionRunnable
+// interface, the Membership runs on every replica
+func (m *Membership) NeedLeaderElection() bool {
+	return false
+}
+
+// Start renews the Leases until the context is cancelled and then releases
+// the shards, it implements the controller-runtime manager Runnable interface
+func (m *Membership) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("sharding")
+	if m.Shards < 1 {
+		return fmt.Errorf("invalid number of shards %d", m.Shards)
+	}
+
+	m.mu.Lock()
+	m.renewed = map[int]time.Time{}
+	m.mu.Unlock()
+
+	for {
+		if err := m.sync(ctx); err != nil {
+			logger.Error(err, "Error syncing shard membership")
+		}
+
+		select {
+		case <-ctx.Done():
+			m.release()
+			return nil
+		case <-time.After(m.LeaseDuration / 3):
+		}
+	}
+}
+
+// sync renews the member Lease and acquires, renews or releases the shard
+// Leases assigned to the replica
+func (m *Membership) sync(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("sharding")
+
+	if err := m.renewLease(ctx, memberLeasePrefix+m.Identity, map[string]string{MemberLabel: "true"}, true); err != nil {
+		return err
+	}
+
+	members, err := m.members(ctx)
+	if err != nil {
+		return err
+	}
+
+	for shard := 0; shard < m.Shards; shard++ {
+		assigned := members[shard%len(members)] == m.Identity
+		name := fmt.Sprintf("%s%d", shardLeasePrefix, shard)
+
+		if !assigned {
+			if m.holds(shard) {
+				logger.Info("Releasing shard", "shard", shard)
+				m.drop(shard)
+				if err := m.releaseLease(ctx, name); err != nil {
+					logger.Error(err, "Error releasing shard", "shard", shard)
+				}
+				m.released(ctx, shard)
+			}
+			continue
+		}
+
+		// the deadline counts from before the request, the Lease is renewed
+		// with a renew time of at least this time
+		renewed := time.Now()
+		acquired := !m.holds(shard)
+		if err := m.renewLease(ctx, name, nil, false); err != nil {
+			m.drop(shard)
+			if !errors.IsConflict(err) {
+				logger.Error(err, "Error acquiring shard", "shard", shard)
+			}
+			if !acquired {
+				logger.Info("Lost shard", "shard", shard)
+				m.released(ctx, shard)
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		m.renewed[shard] = renewed
+		m.mu.Unlock()
+
+		if acquired {
+			logger.Info("Acquired shard", "shard", shard)
+			for _, f := range m.handlers {
+				go f(ctx, shard)
+			}
+		}
+	}
+
+	m.mu.RLock()
+	metrics.ShardsOwned.Set(float64(len(m.renewed)))
+	m.mu.RUnlock()
+
+	return nil
+}
+
+// members returns the sorted identities of the replicas with an unexpired
+// member Lease, expired member Leases are removed
+func (m *Membership) members(ctx context.Context) ([]string, error) {
+	list := &coordinationv1.LeaseList{}
+	err := m.Reader.List(ctx, list, client.InNamespace(m.Namespace), client.MatchingLabels{MemberLabel: "true"})
+	if err != nil {
+		return nil, err
+	}
+
+	members := []string{m.Identity}
+	for i := range list.Items {
+		l := &list.Items[i]
+		if l.Spec.HolderIdentity == nil || *l.Spec.HolderIdentity == m.Identity {
+			continue
+		}
+		if m.expired(l) {
+			_ = m.Client.Delete(ctx, l, client.Preconditions{ResourceVersion: &l.ResourceVersion})
+			continue
+		}
+		members = append(members, *l.Spec.HolderIdentity)
+	}
+	sort.Strings(members)
+
+	return members, nil
+}
+
+// renewLease creates the Lease or renews it when it is held by the replica,
+// a Lease held by another replica is only taken over when it expired
+func (m *Membership) renewLease(ctx context.Context, name string, labels map[string]string, force bool) error {
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{}
+	err := m.Reader.Get(ctx, types.NamespacedName{Name: name, Namespace: m.Namespace}, lease)
+	if err != nil && errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: m.Namespace, Labels: labels},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(m.Identity),
+				LeaseDurationSeconds: pointer.Int32(int32(m.LeaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		return m.Client.Create(ctx, lease)
+	} else if err != nil {
+		return err
+	}
+
+	held := lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == m.Identity
+	free := lease.Spec.HolderIdentity == nil || len(*lease.Spec.HolderIdentity) == 0 || m.expired(lease)
+	if !held && !free && !force {
+		return errors.NewConflict(coordinationv1.Resource("leases"), name,
+			fmt.Errorf("held by %s", *lease.Spec.HolderIdentity))
+	}
+
+	if !held {
+		lease.Spec.HolderIdentity = pointer.String(m.Identity)
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(m.LeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+
+	// the update fails with a conflict when another replica wrote the
+	// Lease after it was read
+	return m.Client.Update(ctx, lease)
+}
+
+// releaseLease clears the holder of a Lease held by the replica
+func (m *Membership) releaseLease(ctx context.Context, name string) error {
+	lease := &coordinationv1.Lease{}
+	err := m.Reader.Get(ctx, types.NamespacedName{Name: name, Namespace: m.Namespace}, lease)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != m.Identity {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = pointer.String("")
+	return m.Client.Update(ctx, lease)
+}
+
+// release gives up all shards and removes the member Lease on shutdown so
+// the remaining replicas take over without waiting for the Leases to expire
+func (m *Membership) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.LeaseDuration)
+	defer cancel()
+
+	m.mu.Lock()
+	shards := make([]int, 0, len(m.renewed))
+	for shard := range m.renewed {
+		shards = append(shards, shard)
+	}
+	m.renewed = map[int]time.Time{}
+	m.mu.Unlock()
+
+	for _, shard := range shards {
+		_ = m.releaseLease(ctx, fmt.Sprintf("%s%d", shardLeasePrefix, shard))
+	}
+	_ = m.Client.Delete(ctx, &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{
+		Name: memberLeasePrefix + m.Identity, Namespace: m.Namespace}})
+	metrics.ShardsOwned.Set(0)
+}
+
+// released runs the release handlers of the shard
+func (m *Membership) released(ctx context.Context, shard int) {
+	for _, f := range m.releases {
+		go f(ctx, shard)
+	}
+}
+
+func (m *Membership) holds(shard int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.renewed[shard]
+	return ok
+}
+
+func (m *Membership) drop(shard int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.renewed, shard)
+}
+
+func (m *Membership) expired(l *coordinationv1.Lease) bool {
+	if l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	return time.Since(l.Spec.RenewTime.Time) > time.Duration(*l.Spec.LeaseDurationSeconds)*time.Second
+}
@@ -0,0 +1,143 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newMembers(identities ...string) []*Membership {
+	c := fake.NewClientBuilder().Build()
+
+	var members []*Membership
+	for _, id := range identities {
+		members = append(members, &Membership{
+			Client:        c,
+			Reader:        c,
+			Namespace:     "cdtarget-operator",
+			Identity:      id,
+			Shards:        4,
+			LeaseDuration: time.Minute,
+			renewed:       map[int]time.Time{},
+		})
+	}
+
+	return members
+}
+
+func TestMembershipSpreadsShards(t *testing.T) {
+	ctx := context.Background()
+	members := newMembers("replica-a", "replica-b")
+
+	// the second round acquires the shards released after both members joined
+	for round := 0; round < 2; round++ {
+		for _, m := range members {
+			if err := m.sync(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		ns := fmt.Sprintf("team-%d", i)
+		owners := 0
+		for _, m := range members {
+			if m.Owns(ns) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Errorf("namespace %s owned by %d replicas, want 1", ns, owners)
+		}
+	}
+}
+
+func TestMembershipFailover(t *testing.T) {
+	ctx := context.Background()
+	members := newMembers("replica-a", "replica-b")
+	for round := 0; round < 2; round++ {
+		for _, m := range members {
+			if err := m.sync(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	members[0].release()
+	if err := members[1].sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for shard := 0; shard < 4; shard++ {
+		if !members[1].holds(shard) {
+			t.Errorf("shard %d not taken over", shard)
+		}
+	}
+}
+
+func TestMembershipRenewDeadline(t *testing.T) {
+	ctx := context.Background()
+	m := newMembers("replica-a")[0]
+	if err := m.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Owns("team-0") {
+		t.Fatal("namespace not owned after renewal")
+	}
+
+	// the Lease is not expired yet, but the replica stops reconciling
+	m.renewed[m.ShardFor("team-0")] = time.Now().Add(-m.LeaseDuration * 3 / 4)
+	if m.Owns("team-0") {
+		t.Error("namespace owned after the renew deadline")
+	}
+}
+
+func TestMembershipAcquireDoesNotBlock(t *testing.T) {
+	ctx := context.Background()
+	m := newMembers("replica-a")[0]
+	block := make(chan struct{})
+	defer close(block)
+	m.OnAcquire(func(ctx context.Context, shard int) { <-block })
+
+	done := make(chan error, 1)
+	go func() { done <- m.sync(ctx) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync blocked by the acquire handlers")
+	}
+}
+
+func TestMembershipRelease(t *testing.T) {
+	ctx := context.Background()
+	members := newMembers("replica-a", "replica-b")
+	released := make(chan int, 4)
+	members[0].OnRelease(func(ctx context.Context, shard int) { released <- shard })
+
+	// replica-a releases the shards assigned to replica-b after it joined
+	for _, m := range []*Membership{members[0], members[1], members[0]} {
+		if err := m.sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := map[int]bool{}
+	for len(got) < 2 {
+		select {
+		case shard := <-released:
+			if members[0].holds(shard) {
+				t.Errorf("release handler called for held shard %d", shard)
+			}
+			got[shard] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("released shards %v, want 2", got)
+		}
+	}
+}
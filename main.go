@@ -20,6 +20,8 @@ import (
 	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -27,15 +29,20 @@ import (
 
 	kedav2 "github.com/kedacore/keda/v2/apis/keda/v1alpha1"
 	apiv2 "github.com/operator-framework/api/pkg/operators/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/config/v1alpha1"
 	cnadv1alpha1 "github.com/bartvanbenthem/cdtarget-operator/api/v1alpha1"
 	"github.com/bartvanbenthem/cdtarget-operator/controllers"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/operatorconfig"
+	"github.com/bartvanbenthem/cdtarget-operator/controllers/sharding"
 	"github.com/operator-framework/operator-lib/leader"
 	//+kubebuilder:scaffold:imports
 )
@@ -45,11 +52,17 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+const (
+	defaultOperatorNamespace = "cdtarget-operator"
+	serviceAccountNamespace  = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(cnadv1alpha1.AddToScheme(scheme))
 	utilruntime.Must(apiv2.AddToScheme(scheme))
 	utilruntime.Must(kedav2.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -57,11 +70,43 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var staleAgentInterval time.Duration
+	var staleAgentMaxAge time.Duration
+	var operatorNamespace string
+	var operatorDeployment string
+	var configFile string
+	var watchNamespaces string
+	var maxConcurrentReconciles int
+	var shards int
+	var shardLeaseDuration time.Duration
+	flag.StringVar(&configFile, "config", "",
+		"The controller will load its initial configuration from this file. "+
+			"Omit this flag to use the default configuration values. "+
+			"The operator settings in the file are reloaded when the file changes.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&staleAgentInterval, "stale-agent-sweep-interval", 15*time.Minute,
+		"Interval between the removal sweeps of stale offline agents, 0 disables the sweep.")
+	flag.DurationVar(&staleAgentMaxAge, "stale-agent-max-age", time.Hour,
+		"Minimum time an agent without a running pod is offline before it is removed from the agent pool.")
+	flag.StringVar(&operatorNamespace, "operator-namespace", "",
+		"Namespace the operator is installed in. Defaults to the OPERATOR_NAMESPACE environment variable, "+
+			"the service account namespace or "+defaultOperatorNamespace+".")
+	flag.StringVar(&operatorDeployment, "operator-deployment", "cdtarget-controller-manager",
+		"Name of the operator Deployment, used to detect an OLM managed installation.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated namespaces the operator watches. Defaults to the WATCH_NAMESPACE environment "+
+			"variable, all namespaces are watched when both are empty.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"Number of CDTargets reconciled in parallel.")
+	flag.IntVar(&shards, "shards", 0,
+		"Number of namespace shards spread over the operator replicas through Leases, "+
+			"0 disables sharding and runs a single active replica.")
+	flag.DurationVar(&shardLeaseDuration, "shard-lease-duration", 15*time.Second,
+		"Time after which the shards of an unresponsive replica are taken over.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -70,36 +115,153 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	if !enableLeaderElection {
-		err := leader.Become(context.TODO(), "cdtarget-operator-lock")
-		if err != nil {
-			setupLog.Error(err, "unable to acquire leader lock")
-			os.Exit(1)
-		}
+	if len(operatorNamespace) == 0 {
+		operatorNamespace = getOperatorNamespace()
 	}
+	setupLog.Info("operator namespace", "namespace", operatorNamespace, "deployment", operatorDeployment)
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	var err error
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "873894c7.gofound.nl",
+	}
+	if len(configFile) > 0 {
+		// flags set on the command line take precedence over the config
+		// file, the flag defaults apply to the settings the file leaves empty
+		explicit := ctrl.Options{Scheme: scheme}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "metrics-bind-address":
+				explicit.MetricsBindAddress = metricsAddr
+			case "health-probe-bind-address":
+				explicit.HealthProbeBindAddress = probeAddr
+			case "leader-elect":
+				explicit.LeaderElection = enableLeaderElection
+			}
+		})
+		fromFile, err := explicit.AndFrom(
+			ctrl.ConfigFile().AtPath(configFile).OfKind(&configv1alpha1.OperatorConfig{}))
+		if err != nil {
+			setupLog.Error(err, "unable to load the config file")
+			os.Exit(1)
+		}
+		if len(fromFile.MetricsBindAddress) == 0 {
+			fromFile.MetricsBindAddress = options.MetricsBindAddress
+		}
+		if len(fromFile.HealthProbeBindAddress) == 0 {
+			fromFile.HealthProbeBindAddress = options.HealthProbeBindAddress
+		}
+		if fromFile.Port == 0 {
+			fromFile.Port = options.Port
+		}
+		if len(fromFile.LeaderElectionID) == 0 {
+			fromFile.LeaderElectionID = options.LeaderElectionID
+		}
+		options = fromFile
+	}
+
+	// restrict the cache to the watched namespaces and the operator
+	// namespace that contains the ports ConfigMap
+	if namespaces := getWatchNamespaces(watchNamespaces, operatorNamespace); len(namespaces) == 1 {
+		setupLog.Info("watching a single namespace", "namespace", namespaces[0])
+		options.Namespace = namespaces[0]
+	} else if len(namespaces) > 1 {
+		setupLog.Info("watching multiple namespaces", "namespaces", namespaces)
+		options.Namespace = ""
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+
+	// the flags are the defaults for the operator settings of the config file
+	operatorConfig, err := operatorconfig.NewStore(configFile, &configv1alpha1.OperatorConfig{
+		Resync: configv1alpha1.ResyncConfig{
+			StaleAgentSweepInterval: &metav1.Duration{Duration: staleAgentInterval},
+			StaleAgentMaxAge:        &metav1.Duration{Duration: staleAgentMaxAge},
+		},
 	})
+	if err != nil {
+		setupLog.Error(err, "unable to load the operator configuration")
+		os.Exit(1)
+	}
+
+	// with sharding every replica is active, the shard Leases replace
+	// the leader election
+	if shards > 0 {
+		setupLog.Info("sharding enabled, leader election disabled", "shards", shards)
+		options.LeaderElection = false
+	} else if !options.LeaderElection {
+		err := leader.Become(context.TODO(), "cdtarget-operator-lock")
+		if err != nil {
+			setupLog.Error(err, "unable to acquire leader lock")
+			os.Exit(1)
+		}
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	var membership *sharding.Membership
+	if shards > 0 {
+		identity, err := os.Hostname()
+		if err != nil {
+			setupLog.Error(err, "unable to determine the replica identity")
+			os.Exit(1)
+		}
+		membership = &sharding.Membership{
+			Client:        mgr.GetClient(),
+			Reader:        mgr.GetAPIReader(),
+			Namespace:     operatorNamespace,
+			Identity:      identity,
+			Shards:        shards,
+			LeaseDuration: shardLeaseDuration,
+		}
+	}
+
 	if err = (&controllers.CDTargetReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("cdtarget-controller"),
+
+		OperatorNamespace:  operatorNamespace,
+		OperatorDeployment: operatorDeployment,
+		Config:             operatorConfig,
+
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		Sharding:                membership,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CDTarget")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
 
+	if err = mgr.Add(operatorConfig); err != nil {
+		setupLog.Error(err, "unable to add operator configuration reload")
+		os.Exit(1)
+	}
+
+	if err = mgr.Add(&controllers.StaleAgentCollector{
+		Client:   mgr.GetClient(),
+		Recorder: mgr.GetEventRecorderFor("cdtarget-controller"),
+		Config:   operatorConfig,
+		Sharding: membership,
+	}); err != nil {
+		setupLog.Error(err, "unable to add stale agent collector")
+		os.Exit(1)
+	}
+
+	if membership != nil {
+		if err = mgr.Add(membership); err != nil {
+			setupLog.Error(err, "unable to add shard membership")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -115,3 +277,45 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// getOperatorNamespace returns the namespace exposed through the downward API,
+// falls back to the namespace of the mounted service account when running
+// in-cluster and to the default install namespace otherwise
+func getOperatorNamespace() string {
+	if ns := os.Getenv("OPERATOR_NAMESPACE"); len(ns) > 0 {
+		return ns
+	}
+
+	if ns, err := os.ReadFile(serviceAccountNamespace); err == nil {
+		if trimmed := strings.TrimSpace(string(ns)); len(trimmed) > 0 {
+			return trimmed
+		}
+	}
+
+	return defaultOperatorNamespace
+}
+
+// getWatchNamespaces returns the namespaces of a namespace scoped install from
+// the flag or the WATCH_NAMESPACE environment variable set by OLM, the operator
+// namespace is always included, nil means all namespaces are watched
+func getWatchNamespaces(flagValue, operatorNamespace string) []string {
+	value := flagValue
+	if len(value) == 0 {
+		value = os.Getenv("WATCH_NAMESPACE")
+	}
+	if len(strings.Trim(value, ", ")) == 0 {
+		return nil
+	}
+
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, ns := range strings.Split(value+","+operatorNamespace, ",") {
+		ns = strings.TrimSpace(ns)
+		if len(ns) > 0 && !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	return namespaces
+}